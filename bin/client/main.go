@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"github.com/ekr/minq"
@@ -21,6 +22,14 @@ func (h *connHandler) StateChanged(s minq.State) {
 func (h *connHandler) NewStream(s *minq.Stream) {
 }
 
+func (h *connHandler) StreamFinished(s *minq.Stream) {
+	fmt.Println("Stream finished id=", s.Id())
+}
+
+func (h *connHandler) StreamReset(s *minq.Stream, code minq.ErrorCode) {
+	fmt.Printf("Stream id=%v reset with error %v\n", s.Id(), code)
+}
+
 func (h *connHandler) StreamReadable(s *minq.Stream) {
 	b := make([]byte, 1024)
 
@@ -79,29 +88,15 @@ func main() {
 
 	utrans := minq.NewUdpTransport(usock, uaddr)
 
-	conn := minq.NewConnection(utrans, minq.RoleClient, minq.TlsConfig{}, &connHandler{})
-
-	// Start things off.
-	_, err = conn.CheckTimer()
-
-	for conn.GetState() != minq.StateEstablished {
-		b, err := readUDP(usock)
-		if err != nil {
-			if err == minq.ErrorWouldBlock {
-				_, err = conn.CheckTimer()
-				if err != nil {
-					return
-				}
-				continue
-			}
-			return
-		}
+	conn := minq.NewConnection(utrans, minq.RoleClient, minq.TlsConfig{
+		// The test server uses a self-signed certificate.
+		InsecureSkipVerify: true,
+	}, &connHandler{})
 
-		err = conn.Input(b)
-		if err != nil {
-			fmt.Println("Error", err)
-			return
-		}
+	err = conn.Connect(context.Background())
+	if err != nil {
+		fmt.Println("Error", err)
+		return
 	}
 
 	fmt.Println("Connection established")
@@ -10,28 +10,16 @@ import (
 
 var addr string
 
-type conn struct {
-	conn *minq.Connection
-	last time.Time
-}
-
-func (c *conn) checkTimer() {
-	t := time.Now()
-	if t.After(c.last.Add(time.Second)) {
-		c.conn.CheckTimer()
-		c.last = time.Now()
-	}
+type serverHandler struct {
 }
 
-var conns = make(map[minq.ConnectionId]*conn)
-
-type serverHandler struct {
+func (h *serverHandler) ShouldAccept(addr *net.UDPAddr) bool {
+	return true
 }
 
 func (h *serverHandler) NewConnection(c *minq.Connection) {
 	fmt.Println("New connection")
 	c.SetHandler(&connHandler{})
-	conns[c.Id()] = &conn{c, time.Now()}
 }
 
 type connHandler struct {
@@ -45,6 +33,14 @@ func (h *connHandler) NewStream(s *minq.Stream) {
 	fmt.Println("Created new stream id=", s.Id())
 }
 
+func (h *connHandler) StreamFinished(s *minq.Stream) {
+	fmt.Println("Stream finished id=", s.Id())
+}
+
+func (h *connHandler) StreamReset(s *minq.Stream, code minq.ErrorCode) {
+	fmt.Printf("Stream id=%v reset with error %v\n", s.Id(), code)
+}
+
 func (h *connHandler) StreamReadable(s *minq.Stream) {
 	fmt.Println("Ready to read for stream id=", s.Id())
 	b := make([]byte, 1024)
@@ -78,10 +74,15 @@ func main() {
 
 	server := minq.NewServer(minq.NewUdpTransportFactory(usock), minq.TlsConfig{}, &serverHandler{})
 
+	next := time.Now()
 	for {
 		b := make([]byte, 8192)
 
-		usock.SetDeadline(time.Now().Add(time.Second))
+		deadline := time.Now().Add(time.Second)
+		if !next.IsZero() && next.Before(deadline) {
+			deadline = next
+		}
+		usock.SetDeadline(deadline)
 		n, addr, err := usock.ReadFromUDP(b)
 		if err != nil {
 			e, o := err.(net.Error)
@@ -107,9 +108,7 @@ func main() {
 			}
 		}
 
-		// Check all the timers
-		for _, c := range conns {
-			c.checkTimer()
-		}
+		// Check the timers of any connections that are due.
+		next = server.CheckTimer()
 	}
 }
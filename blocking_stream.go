@@ -0,0 +1,113 @@
+package minq
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// BlockingStream wraps a Stream so that reads wait for data, which
+// makes it usable with io.Copy() and friends. While waiting it reads
+// packets from the connection's transport and runs its timer, so it
+// must not be used alongside another loop that drives the same
+// connection.
+//
+// BlockingStream implements net.Conn. The addresses come from the
+// transport if it has them, as UdpTransport does.
+type BlockingStream struct {
+	s      *Stream
+	rt     ReadTransport
+	closed bool
+}
+
+// Wrap |s| in a BlockingStream. The connection's transport must be a
+// ReadTransport.
+func NewBlockingStream(s *Stream) (*BlockingStream, error) {
+	rt, ok := s.c.transport.(ReadTransport)
+	if !ok {
+		return nil, fmt.Errorf("BlockingStream needs a ReadTransport")
+	}
+	return &BlockingStream{s, rt, false}, nil
+}
+
+// Read from the stream, waiting until at least one byte is available.
+// Returns io.EOF once the connection is closed and
+// ErrorDeadlineExceeded if the stream's read deadline passes first.
+func (b *BlockingStream) Read(p []byte) (int, error) {
+	if b.closed {
+		return 0, ErrorStreamIsClosed
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for {
+		n, err := b.s.Read(p)
+		if err != ErrorWouldBlock {
+			return n, err
+		}
+		if b.s.c.isClosed() {
+			return 0, io.EOF
+		}
+
+		err = b.s.c.pump(b.rt, b.s.readLimit)
+		if err != nil && err != ErrorWouldBlock {
+			return 0, err
+		}
+	}
+}
+
+// Write to the stream. This never blocks.
+func (b *BlockingStream) Write(p []byte) (int, error) {
+	if b.closed {
+		return 0, ErrorStreamIsClosed
+	}
+	return b.s.Write(p)
+}
+
+// Stop using the stream and send a FIN. Further reads and writes
+// fail; the connection is left open.
+func (b *BlockingStream) Close() error {
+	b.closed = true
+	return b.s.Close()
+}
+
+type addressedTransport interface {
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+}
+
+// Get the local address from the transport, if it has one.
+func (b *BlockingStream) LocalAddr() net.Addr {
+	if at, ok := b.rt.(addressedTransport); ok {
+		return at.LocalAddr()
+	}
+	return &net.UDPAddr{}
+}
+
+// Get the remote address from the transport, if it has one.
+func (b *BlockingStream) RemoteAddr() net.Addr {
+	if at, ok := b.rt.(addressedTransport); ok {
+		return at.RemoteAddr()
+	}
+	return &net.UDPAddr{}
+}
+
+// Set a time after which Read() gives up. A zero time means wait
+// forever. This is the same as the stream's read deadline.
+func (b *BlockingStream) SetReadDeadline(t time.Time) error {
+	b.s.SetReadDeadline(t)
+	return nil
+}
+
+// Set the stream's write deadline.
+func (b *BlockingStream) SetWriteDeadline(t time.Time) error {
+	b.s.SetWriteDeadline(t)
+	return nil
+}
+
+// Set both deadlines.
+func (b *BlockingStream) SetDeadline(t time.Time) error {
+	b.s.SetDeadline(t)
+	return nil
+}
@@ -0,0 +1,120 @@
+package minq
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBlockingStream(t *testing.T) {
+	cTrans, sTrans := newTestTransportPair(true)
+	server := NewConnection(sTrans, RoleServer, testTlsConfig, nil)
+	client := NewConnection(&testConnectTransport{cTrans, server}, RoleClient, testTlsConfig, nil)
+	err := client.Connect(context.Background())
+	assertNotError(t, err, "Couldn't connect")
+
+	bs, err := NewBlockingStream(client.CreateStream())
+	assertNotError(t, err, "Couldn't make blocking stream")
+	n, err := bs.Write([]byte("abc"))
+	assertNotError(t, err, "Couldn't write")
+	assertEquals(t, 3, n)
+
+	// The server only sees the data once the client reads.
+	b := make([]byte, 10)
+	bs.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = bs.Read(b)
+	assertEquals(t, ErrorDeadlineExceeded, err)
+	assertByteEquals(t, []byte("abc"), server.GetStream(1).readAll())
+
+	server.GetStream(1).Write([]byte("xyz"))
+	bs.SetReadDeadline(time.Time{})
+	n, err = bs.Read(b)
+	assertNotError(t, err, "Couldn't read")
+	assertByteEquals(t, []byte("xyz"), b[:n])
+
+	client.Kill()
+	_, err = bs.Read(b)
+	assertEquals(t, io.EOF, err)
+}
+
+func TestStreamNetConn(t *testing.T) {
+	cTrans, sTrans := newTestTransportPair(true)
+	server := NewConnection(sTrans, RoleServer, testTlsConfig, nil)
+	client := NewConnection(&testConnectTransport{cTrans, server}, RoleClient, testTlsConfig, nil)
+	err := client.Connect(context.Background())
+	assertNotError(t, err, "Couldn't connect")
+
+	var conn net.Conn
+	conn, err = client.CreateStream().NetConn()
+	assertNotError(t, err, "Couldn't make net.Conn")
+	assertNotNil(t, conn.LocalAddr(), "No local address")
+
+	_, err = conn.Write([]byte("abc"))
+	assertNotError(t, err, "Couldn't write")
+	err = conn.SetReadDeadline(time.Now())
+	assertNotError(t, err, "Couldn't set deadline")
+	_, err = conn.Read(make([]byte, 10))
+	assertEquals(t, ErrorDeadlineExceeded, err)
+
+	err = conn.Close()
+	assertNotError(t, err, "Couldn't close")
+	_, err = conn.Write([]byte("abc"))
+	assertEquals(t, ErrorStreamIsClosed, err)
+	assertEquals(t, StateEstablished, client.GetState())
+}
+
+func TestBlockingStreamMoreStreams(t *testing.T) {
+	cTrans, sTrans := newTestTransportPair(true)
+	server := NewConnection(sTrans, RoleServer, testTlsConfig, nil)
+	client := NewConnection(&testConnectTransport{cTrans, server}, RoleClient, testTlsConfig, nil)
+	err := client.Connect(context.Background())
+	assertNotError(t, err, "Couldn't connect")
+
+	bs, err := NewBlockingStream(client.CreateStream())
+	assertNotError(t, err, "Couldn't make blocking stream")
+
+	// Opening more streams mustn't leave |bs| looking at an old copy
+	// of its stream.
+	for i := 0; i < 40; i++ {
+		client.CreateStream()
+	}
+	_, err = bs.Write([]byte("abc"))
+	assertNotError(t, err, "Couldn't write")
+	_, err = client.sendQueued(false)
+	assertNotError(t, err, "Couldn't send")
+	err = inputAll(server)
+	assertNotError(t, err, "Couldn't read")
+	server.GetStream(1).Write([]byte("xyz"))
+
+	b := make([]byte, 10)
+	bs.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := bs.Read(b)
+	assertNotError(t, err, "Couldn't read")
+	assertByteEquals(t, []byte("xyz"), b[:n])
+}
+
+func TestBlockingStreamLargeWrite(t *testing.T) {
+	cTrans, sTrans := newTestTransportPair(true)
+	server := NewConnection(sTrans, RoleServer, testTlsConfig, nil)
+	client := NewConnection(&testConnectTransport{cTrans, server}, RoleClient, testTlsConfig, nil)
+	err := client.Connect(context.Background())
+	assertNotError(t, err, "Couldn't connect")
+
+	bs, err := NewBlockingStream(client.CreateStream())
+	assertNotError(t, err, "Couldn't make blocking stream")
+
+	// More than a packet's worth, as io.Copy() would write.
+	data := make([]byte, 5000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	n, err := bs.Write(data)
+	assertNotError(t, err, "Couldn't write")
+	assertEquals(t, len(data), n)
+
+	err = inputAll(server)
+	assertNotError(t, err, "Couldn't read")
+	assertByteEquals(t, data, server.GetStream(1).readAll())
+}
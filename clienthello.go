@@ -0,0 +1,199 @@
+package minq
+
+import (
+	"fmt"
+)
+
+// Information from a ClientHello that is useful for routing a
+// connection before handshaking.
+type ClientHelloInfo struct {
+	ServerName string
+	ALPN       []string
+}
+
+const (
+	kTlsContentTypeHandshake     = 22
+	kTlsHandshakeTypeClientHello = 1
+	kTlsExtensionServerName      = 0
+	kTlsExtensionALPN            = 16
+	kTlsServerNameTypeHostName   = 0
+)
+
+// Extract the contents of stream 0 from a ClientInitial packet without
+// creating a connection. The ClientInitial is only protected with the
+// cleartext AEAD, so anyone can do this. The result is the TLS data
+// the client sent, which can be given to ParseClientHello().
+func DecryptInitial(p []byte) ([]byte, error) {
+	var hdr packetHeader
+
+	hdrlen, err := decode(&hdr, p)
+	if err != nil {
+		return nil, err
+	}
+	if !isLongHeader(&hdr) || hdr.getHeaderType() != packetTypeClientInitial {
+		return nil, fmt.Errorf("Not a ClientInitial")
+	}
+
+	aead := &aeadFNV{}
+	payload, err := aead.Open(nil, encodeArgs(hdr.PacketNumber), p[hdrlen:], p[:hdrlen])
+	if err != nil {
+		return nil, err
+	}
+
+	sf, _, err := decodeClientInitialFrame(payload)
+	if err != nil {
+		return nil, err
+	}
+	return sf.Data, nil
+}
+
+// A cursor for reading TLS structures.
+type tlsReader struct {
+	b []byte
+}
+
+func (r *tlsReader) readUint(size int) (uint64, error) {
+	if len(r.b) < size {
+		return 0, fmt.Errorf("Truncated ClientHello")
+	}
+	var v uint64
+	for _, b := range r.b[:size] {
+		v = (v << 8) | uint64(b)
+	}
+	r.b = r.b[size:]
+	return v, nil
+}
+
+func (r *tlsReader) readBytes(n int) ([]byte, error) {
+	if len(r.b) < n {
+		return nil, fmt.Errorf("Truncated ClientHello")
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v, nil
+}
+
+// Read a vector with a |size| byte length prefix.
+func (r *tlsReader) readVector(size int) (*tlsReader, error) {
+	n, err := r.readUint(size)
+	if err != nil {
+		return nil, err
+	}
+	b, err := r.readBytes(int(n))
+	if err != nil {
+		return nil, err
+	}
+	return &tlsReader{b}, nil
+}
+
+// Pull the server name and ALPN values out of a ClientHello. |ch| can
+// either be a bare handshake message or a handshake record, as
+// returned by DecryptInitial(). The ClientHello must fit in one record.
+func ParseClientHello(ch []byte) (*ClientHelloInfo, error) {
+	r := &tlsReader{ch}
+
+	if len(ch) > 0 && ch[0] == kTlsContentTypeHandshake {
+		// Skip the content type and version.
+		_, err := r.readBytes(3)
+		if err != nil {
+			return nil, err
+		}
+		r, err = r.readVector(2)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	t, err := r.readUint(1)
+	if err != nil {
+		return nil, err
+	}
+	if t != kTlsHandshakeTypeClientHello {
+		return nil, fmt.Errorf("Not a ClientHello: type=%v", t)
+	}
+	r, err = r.readVector(3)
+	if err != nil {
+		return nil, err
+	}
+
+	// legacy_version and random.
+	_, err = r.readBytes(2 + 32)
+	if err != nil {
+		return nil, err
+	}
+	// legacy_session_id, cipher_suites, legacy_compression_methods.
+	for _, size := range []int{1, 2, 1} {
+		_, err = r.readVector(size)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	info := &ClientHelloInfo{}
+	if len(r.b) == 0 {
+		return info, nil
+	}
+	exts, err := r.readVector(2)
+	if err != nil {
+		return nil, err
+	}
+	for len(exts.b) > 0 {
+		et, err := exts.readUint(2)
+		if err != nil {
+			return nil, err
+		}
+		ext, err := exts.readVector(2)
+		if err != nil {
+			return nil, err
+		}
+
+		switch et {
+		case kTlsExtensionServerName:
+			info.ServerName, err = parseServerName(ext)
+		case kTlsExtensionALPN:
+			info.ALPN, err = parseALPN(ext)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return info, nil
+}
+
+func parseServerName(r *tlsReader) (string, error) {
+	names, err := r.readVector(2)
+	if err != nil {
+		return "", err
+	}
+	for len(names.b) > 0 {
+		t, err := names.readUint(1)
+		if err != nil {
+			return "", err
+		}
+		name, err := names.readVector(2)
+		if err != nil {
+			return "", err
+		}
+		if t == kTlsServerNameTypeHostName {
+			return string(name.b), nil
+		}
+	}
+	return "", nil
+}
+
+func parseALPN(r *tlsReader) ([]string, error) {
+	protos, err := r.readVector(2)
+	if err != nil {
+		return nil, err
+	}
+	var alpn []string
+	for len(protos.b) > 0 {
+		p, err := protos.readVector(1)
+		if err != nil {
+			return nil, err
+		}
+		alpn = append(alpn, string(p.b))
+	}
+	return alpn, nil
+}
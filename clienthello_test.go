@@ -0,0 +1,73 @@
+package minq
+
+import (
+	"testing"
+)
+
+// Prefix |b| with a |size| byte length.
+func tlsVector(size int, b []byte) []byte {
+	l := len(b)
+	v := make([]byte, size)
+	for i := size - 1; i >= 0; i-- {
+		v[i] = byte(l)
+		l >>= 8
+	}
+	return append(v, b...)
+}
+
+func makeTestClientHello(sni string, alpn []string) []byte {
+	var protos []byte
+	for _, p := range alpn {
+		protos = append(protos, tlsVector(1, []byte(p))...)
+	}
+	var exts []byte
+	exts = append(exts, 0, kTlsExtensionServerName)
+	exts = append(exts, tlsVector(2, tlsVector(2, append([]byte{kTlsServerNameTypeHostName}, tlsVector(2, []byte(sni))...)))...)
+	exts = append(exts, 0, kTlsExtensionALPN)
+	exts = append(exts, tlsVector(2, tlsVector(2, protos))...)
+
+	var body []byte
+	body = append(body, 3, 3)
+	body = append(body, make([]byte, 32)...)
+	body = append(body, tlsVector(1, nil)...)
+	body = append(body, tlsVector(2, []byte{0x13, 0x01})...)
+	body = append(body, tlsVector(1, []byte{0})...)
+	body = append(body, tlsVector(2, exts)...)
+
+	msg := append([]byte{kTlsHandshakeTypeClientHello}, tlsVector(3, body)...)
+	return append([]byte{kTlsContentTypeHandshake, 3, 1}, tlsVector(2, msg)...)
+}
+
+func TestParseClientHello(t *testing.T) {
+	ch := makeTestClientHello("example.com", []string{"h2", kQuicALPNToken})
+
+	info, err := ParseClientHello(ch)
+	assertNotError(t, err, "Couldn't parse ClientHello")
+	assertEquals(t, "example.com", info.ServerName)
+	assertEquals(t, 2, len(info.ALPN))
+	assertEquals(t, kQuicALPNToken, info.ALPN[1])
+
+	// Without the record header.
+	info, err = ParseClientHello(ch[5:])
+	assertNotError(t, err, "Couldn't parse bare ClientHello")
+	assertEquals(t, "example.com", info.ServerName)
+
+	_, err = ParseClientHello(ch[:len(ch)-1])
+	assertError(t, err, "Parsed a truncated ClientHello")
+}
+
+func TestDecryptInitial(t *testing.T) {
+	pair := newCsPair(t)
+	_, err := pair.client.CheckTimer()
+	assertNotError(t, err, "Couldn't send client initial")
+
+	p := pair.client.transport.(*testTransport).w.out[0].b
+	ch, err := DecryptInitial(p)
+	assertNotError(t, err, "Couldn't decrypt ClientInitial")
+	assertByteEquals(t, pair.client.clientInitial, ch)
+
+	// Corrupt the packet.
+	p[len(p)-1] ^= 0xff
+	_, err = DecryptInitial(p)
+	assertError(t, err, "Decrypted a corrupted ClientInitial")
+}
@@ -161,6 +161,10 @@ func encode(i interface{}) (ret []byte, err error) {
 }
 
 func uintDecodeInt(buf *bytes.Reader, size uintptr) (uint64, error) {
+	// Fields that are absent have no bytes, even at the end of the buffer.
+	if size == 0 {
+		return 0, nil
+	}
 	val := make([]byte, size)
 	rv, err := buf.Read(val)
 	if err != nil {
@@ -8,10 +8,16 @@ package minq
 
 import (
 	"bytes"
+	"context"
 	"crypto/cipher"
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"sort"
+	"syscall"
+	"time"
 )
 
 const (
@@ -29,6 +35,7 @@ const (
 	StateWaitClientSecondFlight = State(4)
 	StateEstablished            = State(5)
 	StateClosed                 = State(6)
+	StateError                  = State(7)
 )
 
 const (
@@ -36,6 +43,13 @@ const (
 	kLongHeaderLength            = 17
 	kInitialIntegrityCheckLength = 8    // FNV-1a 64
 	kInitialMTU                  = 1252 // 1280 - UDP headers.
+	kMinimumMTU                  = 1232 // 1280 - IPv6 + UDP headers.
+	kMaximumMTU                  = 1452 // 1500 - IPv6 + UDP headers.
+	kMTUProbeStep                = 100
+	kRetransmitInterval          = time.Second
+	kAmplificationFactor         = 3
+	kHandshakeStallTimeouts      = 3
+	kKeyUpdatePackets            = 1 << 23 // The AES-GCM confidentiality limit.
 )
 
 // The protocol version number.
@@ -52,6 +66,24 @@ const (
 	kQuicALPNToken = "hq-05"
 )
 
+// The largest stream ID we let the peer open, unless
+// SetMaxRemoteStreamId() says otherwise.
+const (
+	kDefaultMaxRemoteStreamId = 1000
+)
+
+// The most frames, not counting PADDING, that we will read from one
+// packet.
+const (
+	kMaxFramesPerPacket = 256
+)
+
+// The number of ACK-eliciting packets we receive before
+// sending an ACK immediately.
+const (
+	kDefaultAckThreshold = 2
+)
+
 // Interface for the handler object which the Connection will call
 // to notify of events on the connection.
 type ConnectionHandler interface {
@@ -64,6 +96,14 @@ type ConnectionHandler interface {
 
 	// Stream |s| is now readable.
 	StreamReadable(s *Stream)
+
+	// All the data on stream |s| has arrived. Once it has been
+	// read, Read() returns io.EOF.
+	StreamFinished(s *Stream)
+
+	// The peer reset stream |s| with error |code|. Any unread
+	// data is discarded and reads will return ErrorStreamIsReset.
+	StreamReset(s *Stream, code ErrorCode)
 }
 
 // Internal structure indicating ranges to ACK
@@ -72,11 +112,18 @@ type ackRange struct {
 	count      uint64
 }
 
+// The default number of packets we remember receiving. Packets older
+// than this are treated as duplicates.
+const (
+	kDefaultMaxRecvdPackets = 4096
+)
+
 // Internal structure indicating packets we have
 // received
 type recvdPacketsInt struct {
 	r   []bool
 	min uint64
+	max int
 }
 
 type recvdPackets struct {
@@ -94,9 +141,10 @@ The control discipline is entirely operated by the consuming
 application. It has two major responsibilities:
 
   1. Deliver any incoming datagrams using Input()
-  2. Periodically call CheckTimer(). In future there will be some
-     way to know how often to call it, but right now it treats
-     every call to CheckTimer() as timer expiry.
+  2. Call CheckTimer() when the time returned by NextTimerExpiry()
+     is reached. Calling it early only resends data whose timers
+     have expired, except that a client resends its ClientInitial
+     on every call.
 
 The application provides a handler object which the Connection
 calls to notify it of various events.
@@ -114,18 +162,66 @@ type Connection struct {
 	readClear      cipher.AEAD
 	writeProtected *cryptoState
 	readProtected  *cryptoState
+	readPrevious   *cryptoState
+	writePhase     uint8
+	readPhase      uint8
+	readPhaseStart uint64
 	nextSendPacket uint64
 	mtu            int
-	streams        []Stream
+	streams        []*Stream
 	maxStream      uint32
 	clientInitial  []byte
 	recvd          recvdPackets
 	sentAcks       map[uint64][]ackRange
+	ackThreshold   int
+	unackedCount   int
+	tracer         Tracer
+	lastSend       time.Time
+	sentPackets    map[uint64]sentPacket
+	rtt            RttStats
+	sendRotation   int
+	streamIdle     time.Duration
+	// Until the client's address is validated a server can only send
+	// kAmplificationFactor times what it has received.
+	addressValidated bool
+	bytesRecvd       uint64
+	bytesSent        uint64
+	stallTimeouts    int
+	mtuMax           int
+	mtuProbeSize     int // Zero if there is no probe outstanding.
+	mtuProbePN       uint64
+	mtuProbeSent     time.Time
+	handshakeStart   time.Time
+	handshakeTime    time.Duration
+	restarted        bool
+	loss             LossDetector
+	bufferLimit      int
+	// Packets with stream data that we declared lost, and when.
+	lostPackets map[uint64]time.Time
+	spurious    int
+	// Packets protected with the current send keys.
+	keyPackets      uint64
+	keyUpdateLimit  uint64
+	largestRecvd    uint64
+	maxRemoteStream uint32
+}
+
+// When and how we sent a packet.
+type sentPacket struct {
+	time time.Time
+	pt   uint8
 }
 
 // Create a new QUIC connection. Should only be used with role=RoleClient,
 // though we use it with RoleServer internally.
 func NewConnection(trans Transport, role uint8, tls TlsConfig, handler ConnectionHandler) *Connection {
+	return NewConnectionWithRandom(trans, role, tls, handler, rand.Reader)
+}
+
+// Create a new QUIC connection which takes its randomness (connection
+// ID and initial packet number) from |random| rather than
+// crypto/rand. This is mostly for deterministic tests.
+func NewConnectionWithRandom(trans Transport, role uint8, tls TlsConfig, handler ConnectionHandler, random io.Reader) *Connection {
 	c := Connection{
 		handler,
 		role,
@@ -139,6 +235,10 @@ func NewConnection(trans Transport, role uint8, tls TlsConfig, handler Connectio
 		&aeadFNV{},
 		nil,
 		nil,
+		nil,
+		packetType1RTTProtectedPhase0,
+		packetType1RTTProtectedPhase0,
+		0,
 		uint64(0),
 		kInitialMTU,
 		nil,
@@ -146,9 +246,36 @@ func NewConnection(trans Transport, role uint8, tls TlsConfig, handler Connectio
 		nil,
 		newRecvdPackets(),
 		make(map[uint64][]ackRange, 0),
+		kDefaultAckThreshold,
+		0,
+		nil,
+		time.Time{},
+		make(map[uint64]sentPacket),
+		RttStats{},
+		0,
+		0,
+		role == RoleClient,
+		0,
+		0,
+		0,
+		kMaximumMTU,
+		0,
+		0,
+		time.Time{},
+		time.Now(),
+		0,
+		false,
+		newDefaultLossDetector(),
+		0,
+		make(map[uint64]time.Time),
+		0,
+		0,
+		kKeyUpdatePackets,
+		0,
+		kDefaultMaxRemoteStreamId,
 	}
 
-	tmp, err := generateRand64()
+	tmp, err := generateRand64(random)
 	if err != nil {
 		return nil
 	}
@@ -159,7 +286,7 @@ func NewConnection(trans Transport, role uint8, tls TlsConfig, handler Connectio
 		c.serverConnId = connId
 		c.setState(StateWaitClientInitial)
 	}
-	tmp, err = generateRand64()
+	tmp, err = generateRand64(random)
 	if err != nil {
 		return nil
 	}
@@ -173,9 +300,21 @@ func (c *Connection) zeroRttAllowed() bool {
 	return false
 }
 
-func (c *Connection) expandPacketNumber(pn uint64) uint64 {
-	// Placeholder
-	return pn
+// Work out a full packet number from its low |size| octets. This
+// picks the packet number closest to the one after the largest
+// received so far.
+func (c *Connection) expandPacketNumber(pn uint64, size uintptr) uint64 {
+	win := uint64(1) << (8 * size)
+	hwin := win / 2
+	expected := c.largestRecvd + 1
+	candidate := (expected &^ (win - 1)) | pn
+	if candidate+hwin <= expected {
+		return candidate + win
+	}
+	if candidate > expected+hwin && candidate >= win {
+		return candidate - win
+	}
+	return candidate
 }
 
 func (c *Connection) start() error {
@@ -195,9 +334,26 @@ func (c *Connection) setState(state State) {
 	}
 
 	logf(logTypeConnection, "%s: Connection state %s -> %v", c.label(), stateName(c.state), stateName(state))
+	switch {
+	case c.state == StateInit && state == StateWaitServerFirstFlight:
+		// The client's clock starts when it sends its first packet.
+		c.handshakeStart = time.Now()
+	case state == StateEstablished:
+		c.handshakeTime = time.Since(c.handshakeStart)
+	}
 	if c.handler != nil {
 		c.handler.StateChanged(state)
 	}
+	if c.tracer != nil {
+		switch state {
+		case StateWaitServerFirstFlight, StateWaitClientSecondFlight:
+			c.tracer.HandshakeStarted(c)
+		case StateEstablished:
+			c.tracer.HandshakeComplete(c)
+		case StateClosed, StateError:
+			c.tracer.ConnectionClosed(c)
+		}
+	}
 	c.state = state
 }
 
@@ -215,6 +371,10 @@ func stateName(state State) string {
 		return "StateWaitClientSecondFlight"
 	case StateEstablished:
 		return "StateEstablished"
+	case StateClosed:
+		return "StateClosed"
+	case StateError:
+		return "StateError"
 	default:
 		return "Unknown state"
 	}
@@ -224,9 +384,9 @@ func (c *Connection) ensureStream(id uint32) *Stream {
 	// TODO(ekr@rtfm.com): this is not really done, because we never clean up
 	// TODO(ekr@rtfm.com): Only create streams with the same parity.
 	for i := uint32(len(c.streams)); i <= id; i++ {
-		c.streams = append(c.streams, Stream{id: id, c: c})
+		c.streams = append(c.streams, &Stream{id: i, c: c, lastActive: time.Now()})
 	}
-	return &c.streams[id]
+	return c.streams[id]
 }
 
 func (c *Connection) sendClientInitial() error {
@@ -256,7 +416,11 @@ func (c *Connection) sendClientInitial() error {
 			 * octets for an IPv6 packet and 1252 octets for an IPv4 packet.  In the
 			 * absence of extensions to the IP header, padding to exactly these
 			 * values will result in an IP packet that is 1280 octets. */
-	topad := kMinimumClientInitialLength - (kLongHeaderLength + l + kInitialIntegrityCheckLength)
+	padTo := kMinimumClientInitialLength
+	if c.mtu < padTo {
+		padTo = c.mtu
+	}
+	topad := padTo - (kLongHeaderLength + l + kInitialIntegrityCheckLength)
 	logf(logTypeHandshake, "Padding with %d padding frames", topad)
 
 	// Enqueue the frame for transmission.
@@ -274,8 +438,18 @@ func (c *Connection) sendClientInitial() error {
 }
 
 func (c *Connection) sendPacketRaw(pt uint8, payload []byte) error {
+	return c.handleSendError(c.sendPacketSized(pt, payload, c.mtu))
+}
+
+// Protect and send a packet of at most |mtu| bytes. Errors from the
+// transport are returned as they are.
+func (c *Connection) sendPacketSized(pt uint8, payload []byte, mtu int) error {
 	logf(logTypeConnection, "%v: Sending packet of pt=%v len=%v", c.label(), pt, len(payload))
-	left := c.mtu
+	left := mtu
+
+	if pt == packetType1RTTProtectedPhase0 || pt == packetType1RTTProtectedPhase1 {
+		pt = c.writePhase
+	}
 
 	var connId ConnectionId
 	var aead cipher.AEAD
@@ -313,7 +487,6 @@ func (c *Connection) sendPacketRaw(pt uint8, payload []byte) error {
 		},
 		nil,
 	}
-	c.nextSendPacket++
 
 	// Encode the header so we know how long it is.
 	// TODO(ekr@rtfm.com): this is gross.
@@ -325,35 +498,117 @@ func (c *Connection) sendPacketRaw(pt uint8, payload []byte) error {
 
 	assert(left >= len(payload))
 
+	// A held packet doesn't use up a packet number, which is how
+	// the caller can tell that it wasn't sent.
+	length := len(hdr) + len(payload) + aead.Overhead()
+	if !c.addressValidated {
+		if c.bytesSent+uint64(length) > kAmplificationFactor*c.bytesRecvd {
+			// The data is still queued, so it will go out once the
+			// client has proven its address.
+			logf(logTypeConnection, "%s: Holding packet len=%d until the address is validated, sent=%d recvd=%d",
+				c.label(), length, c.bytesSent, c.bytesRecvd)
+			return nil
+		}
+		c.bytesSent += uint64(length)
+	}
+	c.nextSendPacket++
+
 	p.payload = payload
 	protected := aead.Seal(nil, c.packetNonce(p.PacketNumber), p.payload, hdr)
 	packet := append(hdr, protected...)
 
 	logf(logTypeTrace, "Sending packet len=%d, len=%v", len(packet), hex.EncodeToString(packet))
-	c.transport.Send(packet)
+	err = c.transport.Send(packet)
+	if err != nil {
+		return err
+	}
+	c.lastSend = time.Now()
+	c.sentPackets[p.PacketNumber] = sentPacket{c.lastSend, pt}
+
+	// Update the keys before they have been used too much. If the
+	// peer hasn't followed the last update yet, try again next time.
+	if pt == packetType1RTTProtectedPhase0 || pt == packetType1RTTProtectedPhase1 {
+		c.keyPackets++
+		if c.keyUpdateLimit != 0 && c.keyPackets >= c.keyUpdateLimit && c.writePhase == c.readPhase {
+			logf(logTypeConnection, "%s: Sent %v packets with these keys, updating", c.label(), c.keyPackets)
+			return c.updateWriteKeys()
+		}
+	}
 
 	return nil
 }
 
+// Classify an error from the transport. A packet that was too big
+// for the path shrinks the MTU and a lack of buffer space is
+// transient. In both cases the data is still queued and will be
+// resent from CheckTimer(). Anything else is returned.
+func (c *Connection) handleSendError(err error) error {
+	if err == nil {
+		return nil
+	}
+	switch {
+	case errors.Is(err, syscall.EMSGSIZE):
+		if c.mtu <= kMinimumMTU {
+			return err
+		}
+		logf(logTypeConnection, "%s: Packet too big, reducing MTU %v -> %v", c.label(), c.mtu, kMinimumMTU)
+		c.mtu = kMinimumMTU
+		c.mtuMax = kMinimumMTU
+		c.stallTimeouts = 0
+		return nil
+	case errors.Is(err, syscall.ENOBUFS):
+		// Count this as a send, so that the timers wait a while
+		// before trying again.
+		logf(logTypeConnection, "%s: Transport out of buffers, will retry", c.label())
+		c.lastSend = time.Now()
+		return nil
+	}
+	return err
+}
+
 func (c *Connection) sendPacket(pt uint8, tosend []frame) error {
 	logf(logTypeConnection, "%s: Sending packet of type %v. %v frames", c.label(), pt, len(tosend))
 	logf(logTypeTrace, "Sending packet of type %v. %v frames", pt, len(tosend))
 	sent := 0
 
 	payload := make([]byte, 0)
+	ackOnly := true
 
 	for _, f := range tosend {
 		_, err := f.length()
 		if err != nil {
 			return err
 		}
+		if _, ok := f.f.(*ackFrame); !ok {
+			ackOnly = false
+		}
 
 		logf(logTypeTrace, "Frame=%v", hex.EncodeToString(f.encoded))
 		payload = append(payload, f.encoded...)
 		sent++
 	}
 
-	return c.sendPacketRaw(pt, payload)
+	pn := c.nextSendPacket
+	err := c.sendPacketRaw(pt, payload)
+	if err != nil {
+		return err
+	}
+	c.packetSent(pn, ackOnly)
+	return nil
+}
+
+// Tell the loss detector about packet |pn|, if it went out. Nobody
+// acknowledges a packet with only ACKs in it, so don't wait for that.
+func (c *Connection) packetSent(pn uint64, ackOnly bool) {
+	sent, ok := c.sentPackets[pn]
+	if !ok {
+		return
+	}
+	if ackOnly {
+		delete(c.sentPackets, pn)
+		return
+	}
+	c.loss.PacketSent(pn, sent.time, c.carriesData(pn))
 }
 
 func (c *Connection) sendFramesInPacket(pt uint8, tosend []frame) error {
@@ -465,7 +720,7 @@ func (c *Connection) makeAckFrame(acks []ackRange, maxlength int) (*frame, int,
 }
 
 func (c *Connection) sendQueued(bareAcks bool) (int, error) {
-	if c.state == StateInit || c.state == StateWaitClientInitial {
+	if c.state == StateInit || c.state == StateWaitClientInitial || c.isClosed() {
 		return 0, nil
 	}
 
@@ -488,7 +743,7 @@ func (c *Connection) sendQueued(bareAcks bool) (int, error) {
 	// is no data and the ACK is a duplicate, just don't send
 	// it.
 	if c.state == StateEstablished {
-		s, err := c.sendQueuedStreams(packetType1RTTProtectedPhase0, c.streams[1:], true, bareAcks)
+		s, err := c.sendQueuedStreams(packetType1RTTProtectedPhase0, c.prioritizedStreams(), true, bareAcks)
 		if err != nil {
 			return sent, err
 		}
@@ -498,11 +753,31 @@ func (c *Connection) sendQueued(bareAcks bool) (int, error) {
 	return sent, nil
 }
 
+// Order the non-zero streams for sending, highest priority first.
+// Streams with the same priority take turns at going first.
+func (c *Connection) prioritizedStreams() []*Stream {
+	n := len(c.streams) - 1
+	if n <= 0 {
+		return nil
+	}
+
+	start := 1 + c.sendRotation%n
+	c.sendRotation++
+	ordered := make([]*Stream, 0, n)
+	ordered = append(ordered, c.streams[start:]...)
+	ordered = append(ordered, c.streams[1:start]...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].priority > ordered[j].priority
+	})
+	return ordered
+}
+
 // Send a packet of stream frames, plus whatever acks fit.
 func (c *Connection) sendStreamPacket(pt uint8, frames []frame, acks []ackRange) (int, error) {
 	left := c.mtu
 	asent := int(0)
 	var err error
+	pn := c.nextSendPacket
 
 	for _, f := range frames {
 		l, err := f.length()
@@ -519,21 +794,47 @@ func (c *Connection) sendStreamPacket(pt uint8, frames []frame, acks []ackRange)
 		if err != nil {
 			return 0, err
 		}
-		frames = append(frames, *af)
+		// The ACK goes first so that the last STREAM frame can
+		// leave out its length.
+		frames = append([]frame{*af}, frames...)
+		c.unackedCount = 0
 	}
 	// Record which packets we sent ACKs in.
 	c.sentAcks[c.nextSendPacket] = acks[0:asent]
 
+	if len(frames) > 0 {
+		frames[len(frames)-1].omitLength()
+	}
+
 	err = c.sendPacket(pt, frames)
 	if err != nil {
 		return 0, err
 	}
+	if c.nextSendPacket == pn {
+		// The packet was held back, so nothing went out in it.
+		c.unsendPacket(pn)
+		return 0, nil
+	}
 
 	return asent, nil
 }
 
+// Forget that packet |pn| carried stream data and ACKs, because it
+// was never sent.
+func (c *Connection) unsendPacket(pn uint64) {
+	delete(c.sentAcks, pn)
+	for _, s := range c.streams {
+		for i := range s.out {
+			pns := s.out[i].pns
+			if n := len(pns); n > 0 && pns[n-1] == pn {
+				s.out[i].pns = pns[:n-1]
+			}
+		}
+	}
+}
+
 // Send all the queued data on a set of streams with packet type |pt|
-func (c *Connection) sendQueuedStreams(pt uint8, streams []Stream, protected bool, bareAcks bool) (int, error) {
+func (c *Connection) sendQueuedStreams(pt uint8, streams []*Stream, protected bool, bareAcks bool) (int, error) {
 	logf(logTypeConnection, "%v: sendQueuedStreams pt=%v, protected=%v, bareAcks=%v",
 		c.label(), pt, protected, bareAcks)
 	left := c.mtu
@@ -543,8 +844,14 @@ func (c *Connection) sendQueuedStreams(pt uint8, streams []Stream, protected boo
 
 	for _, str := range streams {
 		for i, chunk := range str.out {
+			if c.inFlight(&chunk) {
+				continue
+			}
 			logf(logTypeConnection, "Sending chunk of offset=%v len %v", chunk.offset, len(chunk.data))
 			f := newStreamFrame(str.id, chunk.offset, chunk.data)
+			if chunk.fin {
+				f.f.(*streamFrame).Typ |= kFrameTypeFlagF
+			}
 			l, err := f.length()
 			if err != nil {
 				return 0, err
@@ -584,6 +891,18 @@ func (c *Connection) sendQueuedStreams(pt uint8, streams []Stream, protected boo
 	return sent, nil
 }
 
+// Whether |ch| is in a packet that is neither acknowledged nor lost
+// yet. Chunks that aren't in flight are sent by the next
+// sendQueued().
+func (c *Connection) inFlight(ch *streamChunk) bool {
+	for _, pn := range ch.pns {
+		if _, ok := c.sentPackets[pn]; ok {
+			return true
+		}
+	}
+	return false
+}
+
 // Walk through all the streams and see how many bytes are outstanding.
 // Right now this is very expensive.
 
@@ -597,10 +916,24 @@ func (c *Connection) outstandingQueuedBytes() (n int) {
 
 // Provide a packet to the connection.
 //
-// TODO(ekr@rtfm.com): when is error returned?
+// An error is returned if the packet couldn't be processed. If the
+// error matches ErrorFatal (see errors.Is) the connection is now
+// closed and should be discarded; otherwise the packet was dropped
+// and the connection can still be used.
 func (c *Connection) Input(p []byte) error {
+	err := c.input(p)
+	if errors.Is(err, ErrorFatal) && !c.isClosed() {
+		c.setState(StateClosed)
+	}
+	return err
+}
+
+func (c *Connection) input(p []byte) error {
 	if c.isClosed() {
-		return fmt.Errorf("Connection is closed")
+		return ErrorConnIsClosed
+	}
+	if !c.addressValidated {
+		c.bytesRecvd += uint64(len(p))
 	}
 
 	var hdr packetHeader
@@ -613,10 +946,11 @@ func (c *Connection) Input(p []byte) error {
 	}
 	assert(int(hdrlen) <= len(p))
 
-	if hdr.Version != c.version {
+	// Short headers don't have a version.
+	if isLongHeader(&hdr) && hdr.Version != c.version {
 		if c.role == RoleServer {
 			logf(logTypeConnection, "%s: Received unsupported version %v, expected %v", c.label(), hdr.Version, c.version)
-			err = c.sendVersionNegotiation()
+			err = c.sendVersionNegotiation(&hdr)
 			if err != nil {
 				return err
 			}
@@ -633,16 +967,37 @@ func (c *Connection) Input(p []byte) error {
 		}
 	}
 
+	// Short headers can carry just the low bits of the packet number.
+	if !isLongHeader(&hdr) {
+		hdr.PacketNumber = c.expandPacketNumber(hdr.PacketNumber, hdr.PacketNumber__length())
+	}
+
 	aead := c.readClear
+	var nextRead *cryptoState
 	if hdr.isProtected() {
 		if c.readProtected == nil {
 			logf(logTypeConnection, "Received protected data before crypto state is ready")
 			return nil
 		}
 		aead = c.readProtected.aead
+
+		// A flipped key phase is either a reordered packet from
+		// the previous phase or the peer moving to the next one.
+		// If it is neither, the packet won't decrypt.
+		phase := hdr.getHeaderType()
+		if (phase == packetType1RTTProtectedPhase0 || phase == packetType1RTTProtectedPhase1) && phase != c.readPhase {
+			if c.readPrevious != nil && hdr.PacketNumber < c.readPhaseStart {
+				aead = c.readPrevious.aead
+			} else {
+				nextRead, err = c.readProtected.next()
+				if err != nil {
+					return err
+				}
+				aead = nextRead.aead
+			}
+		}
 	}
 
-	// TODO(ekr@rtfm.com): Reconstruct the packet number
 	// TODO(ekr@rtfm.com): this dup detection doesn't work right if you
 	// get a cleartext packet that has the same PN as a ciphertext or vice versa.
 	// Need to fix.
@@ -659,11 +1014,14 @@ func (c *Connection) Input(p []byte) error {
 		return err
 	}
 
-	typ := hdr.getHeaderType()
-	if !isLongHeader(&hdr) {
-		// TODO(ekr@rtfm.com): We are using this for both types.
-		typ = packetType1RTTProtectedPhase0
+	if nextRead != nil {
+		err = c.updateReadKeys(nextRead, hdr.PacketNumber)
+		if err != nil {
+			return err
+		}
 	}
+
+	typ := hdr.getHeaderType()
 	logf(logTypeConnection, "Packet header %v, %d", hdr, typ)
 
 	// Process messages from the server that don't set up the connection
@@ -685,6 +1043,22 @@ func (c *Connection) Input(p []byte) error {
 	// it received.
 
 	c.recvd.packetSetReceived(hdr.PacketNumber, hdr.isProtected())
+	if hdr.PacketNumber > c.largestRecvd {
+		c.largestRecvd = hdr.PacketNumber
+	}
+
+	// A retransmitted ClientInitial doesn't mean that the client is
+	// hearing from us, but anything else does.
+	if typ != packetTypeClientInitial {
+		c.stallTimeouts = 0
+	}
+
+	// A packet with the connection ID that we chose shows that the
+	// client is at the address it claims to be.
+	if !c.addressValidated && typ != packetTypeClientInitial && hdr.ConnectionID == c.serverConnId {
+		logf(logTypeConnection, "%s: Client address validated", c.label())
+		c.addressValidated = true
+	}
 	switch typ {
 	case packetTypeClientInitial:
 		err = c.processClientInitial(&hdr, payload)
@@ -700,11 +1074,9 @@ func (c *Connection) Input(p []byte) error {
 	return err
 }
 
-func (c *Connection) processClientInitial(hdr *packetHeader, payload []byte) error {
-	logf(logTypeHandshake, "Handling client initial packet")
-
-	// Directly parse the ClientInitial rather than inserting it into
-	// the stream processor.
+// Decode the single stream frame at the start of a ClientInitial
+// payload. Returns the frame and whatever follows it.
+func decodeClientInitialFrame(payload []byte) (*streamFrame, []byte, error) {
 	var sf streamFrame
 
 	// Strip off any initial leading bytes.
@@ -721,27 +1093,47 @@ func (c *Connection) processClientInitial(hdr *packetHeader, payload []byte) err
 	n, err := decode(&sf, payload)
 	if err != nil {
 		logf(logTypeConnection, "Failure decoding initial stream frame in ClientInitial")
-		return err
+		return nil, nil, err
 	}
 
 	if sf.StreamId != 0 {
-		return fmt.Errorf("Received ClientInitial with stream id != 0")
+		return nil, nil, fmt.Errorf("Received ClientInitial with stream id != 0")
 	}
 
 	if sf.Offset != 0 {
-		return fmt.Errorf("Received ClientInitial with offset != 0")
+		return nil, nil, fmt.Errorf("Received ClientInitial with offset != 0")
+	}
+
+	return &sf, payload[n:], nil
+}
+
+func (c *Connection) processClientInitial(hdr *packetHeader, payload []byte) error {
+	logf(logTypeHandshake, "Handling client initial packet")
+
+	// Directly parse the ClientInitial rather than inserting it into
+	// the stream processor.
+	sf, payload, err := decodeClientInitialFrame(payload)
+	if err != nil {
+		return err
 	}
 
 	if c.state != StateWaitClientInitial {
 		if uint64(len(sf.Data)) > c.streams[0].readOffset {
-			return fmt.Errorf("Received second ClientInitial which seems to be too long, offset=%v len=%v", c.streams[0].readOffset, n)
+			return fmt.Errorf("Received second ClientInitial which seems to be too long, offset=%v len=%v", c.streams[0].readOffset, len(sf.Data))
 		}
-		return nil
+		// The client didn't get our first flight, so send it again.
+		logf(logTypeHandshake, "%s: Received retransmitted ClientInitial, resending", c.label())
+		for _, ch := range c.streams[0].out {
+			for _, pn := range ch.pns {
+				delete(c.sentPackets, pn)
+			}
+		}
+		_, err = c.sendQueued(false)
+		return err
 	}
 
 	// TODO(ekr@rtfm.com): check that the length is long enough.
 	// TODO(ekr@rtfm.com): check version, etc.
-	payload = payload[n:]
 	logf(logTypeTrace, "Expecting %d bytes of padding", len(payload))
 	for _, b := range payload {
 		if b != 0 {
@@ -752,7 +1144,7 @@ func (c *Connection) processClientInitial(hdr *packetHeader, payload []byte) err
 	c.streams[0].readOffset = uint64(len(sf.Data))
 	sflt, err := c.tls.handshake(sf.Data)
 	if err != nil {
-		return err
+		return c.handshakeFailed(err)
 	}
 
 	logf(logTypeTrace, "Output of server handshake: %v", hex.EncodeToString(sflt))
@@ -780,8 +1172,19 @@ func (c *Connection) processCleartext(hdr *packetHeader, payload []byte) error {
 		}*/
 
 	otherThanAck := false
+	frames := 0
 	for len(payload) > 0 {
 		logf(logTypeConnection, "%s: payload bytes left %d", c.label(), len(payload))
+		if payload[0] == byte(kFrameTypePadding) {
+			payload = bytes.TrimLeft(payload, "\x00")
+			continue
+		}
+		// Anyone can write a cleartext packet, so don't close the
+		// connection over one; just stop reading it.
+		frames++
+		if frames > kMaxFramesPerPacket {
+			return fmt.Errorf("More than %v frames in a packet", kMaxFramesPerPacket)
+		}
 		n, f, err := decodeFrame(payload)
 		if err != nil {
 			logf(logTypeConnection, "Couldn't decode frame %v", err)
@@ -837,13 +1240,13 @@ func (c *Connection) processCleartext(hdr *packetHeader, payload []byte) error {
 			available := c.streams[0].readAll()
 			out, err := c.tls.handshake(available)
 			if err != nil {
-				return err
+				return c.handshakeFailed(err)
 			}
 
 			if c.tls.finished {
 				err = c.handshakeComplete()
 				if err != nil {
-					return err
+					return fatal(err)
 				}
 			}
 
@@ -858,13 +1261,20 @@ func (c *Connection) processCleartext(hdr *packetHeader, payload []byte) error {
 		case *ackFrame:
 			logf(logTypeConnection, "Received ACK, first range=%v-%v", inner.LargestAcknowledged-inner.FirstAckBlockLength, inner.LargestAcknowledged)
 
-			err = c.processAckFrame(inner)
+			err = c.processAckFrame(inner, hdr.isProtected())
 			if err != nil {
 				return err
 			}
 			nonAck = false
 		case *connectionCloseFrame:
 			logf(logTypeConnection, "Received frame close")
+			if ErrorCode(inner.ErrorCode) == kQuicErrorTlsFatalAlertGenerated {
+				// The peer's TLS stack rejected the handshake, which
+				// for us means that we received an alert.
+				c.setState(StateError)
+				return &QuicError{kQuicErrorTlsFatalAlertReceived,
+					fatal(fmt.Errorf("Peer sent a TLS alert: %s", string(inner.ReasonPhrase)))}
+			}
 			c.setState(StateClosed)
 
 		default:
@@ -895,48 +1305,109 @@ func (c *Connection) processCleartext(hdr *packetHeader, payload []byte) error {
 	return nil
 }
 
-func (c *Connection) sendVersionNegotiation() error {
-	p := newVersionNegotiationPacket([]VersionNumber{
+// Send a version negotiation packet in response to |hdr|. The
+// connection ID, packet number and version are copied from the
+// client's packet so that the client can tell that the response is
+// genuine.
+func (c *Connection) sendVersionNegotiation(hdr *packetHeader) error {
+	vn := newVersionNegotiationPacket([]VersionNumber{
 		c.version,
 		kQuicGreaseVersion1,
 	})
-	b, err := encode(p)
+	payload, err := encode(vn)
 	if err != nil {
 		return err
 	}
 
-	return c.sendPacketRaw(packetTypeVersionNegotiation, b)
+	p := packetHeader{
+		packetTypeVersionNegotiation | packetFlagLongHeader,
+		hdr.ConnectionID,
+		hdr.PacketNumber,
+		hdr.Version,
+	}
+	b, err := encode(&p)
+	if err != nil {
+		return err
+	}
+	b = append(b, c.writeClear.Seal(nil, c.packetNonce(p.PacketNumber), payload, b)...)
+
+	logf(logTypeTrace, "Sending version negotiation len=%d, %v", len(b), hex.EncodeToString(b))
+	err = c.transport.Send(b)
+	if err != nil {
+		return c.handleSendError(err)
+	}
+	return nil
 }
 
 func (c *Connection) processVersionNegotiation(hdr *packetHeader, payload []byte) error {
 	logf(logTypeConnection, "%s: Processing version negotiation packet", c.label())
+	// Only a client that is waiting for the server can be told to
+	// change version. Anything else, in particular a version
+	// negotiation packet after we have heard from the server, is
+	// forged or stale.
+	if c.role != RoleClient || c.state != StateWaitServerFirstFlight {
+		logf(logTypeConnection, "%s: Ignoring version negotiation in state %v", c.label(), stateName(c.state))
+		return nil
+	}
 	if c.recvd.initialized() {
 		logf(logTypeConnection, "%s: Ignoring version negotiation after received another packet", c.label())
+		return nil
 	}
 
-	// TODO(ekr@rtfm.com): Ignore version negotiation after receiving
-	// a non-version-negotiation packet.
-	rdr := bytes.NewReader(payload)
+	// The server echoes what we sent.
+	_, sent := c.sentPackets[hdr.PacketNumber]
+	if hdr.ConnectionID != c.clientConnId || hdr.Version != c.version || !sent {
+		logf(logTypeConnection, "%s: Ignoring version negotiation that doesn't match our ClientInitial", c.label())
+		return nil
+	}
 
+	rdr := bytes.NewReader(payload)
+	var chosen VersionNumber
 	for rdr.Len() > 0 {
 		u, err := uintDecodeInt(rdr, 4)
 		if err != nil {
 			return err
 		}
+		v := VersionNumber(u)
 		// Ignore the version we are already speaking.
-		if VersionNumber(u) == c.version {
+		if v == c.version {
 			return nil
 		}
+		if chosen == 0 && v == kQuicVersion {
+			chosen = v
+		}
 	}
 
-	return ErrorReceivedVersionNegotiation
+	if chosen == 0 {
+		return ErrorReceivedVersionNegotiation
+	}
+
+	// Start again with the new version. The ClientHello doesn't depend
+	// on the version so it can be reused.
+	logf(logTypeConnection, "%s: Switching version %v -> %v", c.label(), c.version, chosen)
+	c.version = chosen
+	c.restarted = true
+	return c.sendClientInitial()
 }
 
 func (c *Connection) processUnprotected(hdr *packetHeader, payload []byte) error {
 	logf(logTypeHandshake, "Reading unprotected data in state %v", c.state)
 	otherThanAck := false
+	ackNow := false
+	frames := 0
 	for len(payload) > 0 {
 		logf(logTypeConnection, "%s: payload bytes left %d", c.label(), len(payload))
+		// PADDING is cheap to skip in one go, so it doesn't count
+		// towards the limit.
+		if payload[0] == byte(kFrameTypePadding) {
+			payload = bytes.TrimLeft(payload, "\x00")
+			continue
+		}
+		frames++
+		if frames > kMaxFramesPerPacket {
+			return c.closeWithError(kQuicErrorProtocolViolation,
+				fmt.Errorf("More than %v frames in a packet", kMaxFramesPerPacket))
+		}
 		n, f, err := decodeFrame(payload)
 		if err != nil {
 			logf(logTypeConnection, "Couldn't decode frame %v", err)
@@ -954,26 +1425,61 @@ func (c *Connection) processUnprotected(hdr *packetHeader, payload []byte) error
 			notifyCreated := false
 			s := c.GetStream(inner.StreamId)
 			if s == nil {
+				if inner.StreamId > c.maxRemoteStream {
+					logf(logTypeConnection, "%s: Peer opened stream %v, max is %v", c.label(), inner.StreamId, c.maxRemoteStream)
+					return c.closeWithError(kQuicErrorStreamIdError,
+						fmt.Errorf("Received stream ID %v > %v", inner.StreamId, c.maxRemoteStream))
+				}
 				notifyCreated = true
 			}
 			s = c.ensureStream(inner.StreamId)
 			if notifyCreated && c.handler != nil {
 				c.handler.NewStream(s)
 			}
+			if notifyCreated && c.tracer != nil {
+				c.tracer.StreamOpened(c, s)
+			}
 			if s.newFrameData(inner.Offset, inner.Data) && c.handler != nil {
 				c.handler.StreamReadable(s)
 			}
+			if c.bufferLimit != 0 {
+				if n := c.bufferedBytes(); n > c.bufferLimit {
+					return c.closeWithError(kQuicErrorFlowControlError,
+						fmt.Errorf("%v bytes buffered out of order, limit is %v", n, c.bufferLimit))
+				}
+			}
+			if inner.Typ&kFrameTypeFlagF != 0 {
+				s.receiveFin(inner.Offset + uint64(len(inner.Data)))
+			}
+			if s.newlyFinished() && c.handler != nil {
+				c.handler.StreamFinished(s)
+			}
 		case *ackFrame:
 			logf(logTypeConnection, "Received ACK, first range=%v-%v", inner.LargestAcknowledged-inner.FirstAckBlockLength, inner.LargestAcknowledged)
 
-			err = c.processAckFrame(inner)
+			err = c.processAckFrame(inner, hdr.isProtected())
 			if err != nil {
 				return err
 			}
 			nonAck = false
+		case *rstStreamFrame:
+			logf(logTypeConnection, "Received RST_STREAM on stream %v code=%v", inner.StreamId, inner.ErrorCode)
+			s := c.GetStream(inner.StreamId)
+			if s == nil || inner.StreamId == 0 {
+				logf(logTypeConnection, "%s: Ignoring RST_STREAM for stream %v", c.label(), inner.StreamId)
+				break
+			}
+			if s.resetByPeer() && c.handler != nil {
+				c.handler.StreamReset(s, ErrorCode(inner.ErrorCode))
+			}
 		case *connectionCloseFrame:
 			logf(logTypeConnection, "Received close frame")
 			c.setState(StateClosed)
+		case *pingFrame:
+			// A PING is usually a probe, so the sender is waiting
+			// for the ACK.
+			ackNow = true
+		case *paddingFrame:
 		default:
 			logf(logTypeConnection, "Received unexpected frame type")
 		}
@@ -987,35 +1493,92 @@ func (c *Connection) processUnprotected(hdr *packetHeader, payload []byte) error
 	if !otherThanAck {
 		logf(logTypeAck, "Packet just contained ACKs")
 		c.recvd.packetSetAcked2(hdr.PacketNumber)
+		return nil
+	}
+
+	// Otherwise ACK right away once enough packets are waiting.
+	c.unackedCount++
+	if c.unackedCount >= c.ackThreshold || ackNow {
+		logf(logTypeAck, "%s: %v packets unacknowledged, sending ACK", c.label(), c.unackedCount)
+		_, err := c.sendQueuedStreams(packetType1RTTProtectedPhase0, c.prioritizedStreams(), true, true)
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func (c *Connection) processAckFrame(f *ackFrame) error {
+// Whether an ACK can acknowledge |pn|. Anyone can forge a cleartext
+// packet, so an ACK in one only counts for cleartext packets. A
+// protected ACK counts for anything, including packets sent with
+// either key phase, since packet numbers don't restart on a key
+// update.
+func (c *Connection) ackCovers(pn uint64, protected bool) bool {
+	if protected {
+		return true
+	}
+	sent, ok := c.sentPackets[pn]
+	return ok && (sent.pt == packetTypeClientInitial ||
+		sent.pt == packetTypeClientCleartext ||
+		sent.pt == packetTypeServerCleartext)
+}
+
+func (c *Connection) processAckFrame(f *ackFrame, protected bool) error {
+	ranges, err := f.ranges()
+	if err != nil {
+		return err
+	}
 	end := f.LargestAcknowledged
-	start := end - f.FirstAckBlockLength
+
+	// Take an RTT sample if the largest acknowledged packet is new.
+	sent, ok := c.sentPackets[end]
+	if ok && c.ackCovers(end, protected) {
+		delay := time.Duration(decodeUfloat16(f.AckDelay)) * time.Microsecond
+		c.rtt.update(time.Since(sent.time), delay)
+		logf(logTypeAck, "%s: RTT sample, now %+v", c.label(), c.rtt)
+	}
 
 	// Go through all the ACK blocks and process everything.
-	for {
-		logf(logTypeAck, "%s: processing ACK range %v-%v", c.label(), start, end)
+	var acked []uint64
+	for _, r := range ranges {
+		start := r.lastPacket - r.count + 1
+		logf(logTypeAck, "%s: processing ACK range %v-%v", c.label(), start, r.lastPacket)
 		// Unusual loop structure to avoid weirdness at 2^64-1
 		pn := start
 		for {
-			// TODO(ekr@rtfm.com): properly filter for ACKed packets which are in the
-			// wrong key phase.
 			logf(logTypeConnection, "%s: processing ACK for PN=%v", c.label(), pn)
+			if !c.ackCovers(pn, protected) {
+				logf(logTypeAck, "%s: Ignoring cleartext ACK for protected PN=%v", c.label(), pn)
+				if pn == r.lastPacket {
+					break
+				}
+				pn++
+				continue
+			}
+
+			// 0. If we thought this was lost, the retransmission was
+			//    a waste.
+			if _, ok := c.lostPackets[pn]; ok {
+				logf(logTypeConnection, "%s: Packet %v wasn't lost after all", c.label(), pn)
+				delete(c.lostPackets, pn)
+				c.spurious++
+			}
 
 			// 1. Go through each stream and remove the chunks. This is not
-			//    efficient but fine for now. Note, use of array index
-			//    rather than the iterator because we want to modify
-			//    the stream.
-			for i, _ := range c.streams {
-				st := &(c.streams[i])
+			//    efficient but fine for now.
+			for _, st := range c.streams {
 				st.removeAckedChunks(pn)
 			}
 
-			// 2. Mark all the packets that were ACKed in this packet as double-acked.
+			// 2. A probe getting through means a bigger MTU.
+			if c.mtuProbeSize != 0 && pn == c.mtuProbePN {
+				logf(logTypeConnection, "%s: MTU probe acknowledged, raising MTU %v -> %v", c.label(), c.mtu, c.mtuProbeSize)
+				c.mtu = c.mtuProbeSize
+				c.mtuProbeSize = 0
+			}
+
+			// 3. Mark all the packets that were ACKed in this packet as double-acked.
 			acks, ok := c.sentAcks[pn]
 			if ok {
 				for _, a := range acks {
@@ -1026,23 +1589,28 @@ func (c *Connection) processAckFrame(f *ackFrame) error {
 				}
 			}
 
-			if pn == end {
+			// 4. The packet is no longer in flight.
+			if _, ok := c.sentPackets[pn]; ok {
+				delete(c.sentPackets, pn)
+				acked = append(acked, pn)
+			}
+
+			if pn == r.lastPacket {
 				break
 			}
 			pn++
 		}
-
-		// TODO(ekr@rtfm.com): Process subsequent ACK blocks.
-		break
 	}
 
+	c.handleLostPackets(c.loss.AckReceived(acked, c.rtt))
+
 	// TODO(ekr@rtfm.com): Process the ACK timestamps.
 
 	return nil
 }
 
 func newRecvdPacketsInt() recvdPacketsInt {
-	return recvdPacketsInt{nil, 0}
+	return recvdPacketsInt{nil, 0, kDefaultMaxRecvdPackets}
 }
 
 func (p *recvdPacketsInt) initialized() bool {
@@ -1067,14 +1635,40 @@ func (p *recvdPacketsInt) packetNotReceived(pn uint64) bool {
 	return !p.r[pn-p.min]
 }
 
+func (p *recvdPacketsInt) isSet(pn uint64) bool {
+	if pn < p.min || pn >= p.min+uint64(len(p.r)) {
+		return false
+	}
+	return p.r[pn-p.min]
+}
+
 func (p *recvdPacketsInt) packetSetReceived(pn uint64) {
-	assert(pn >= p.min)
 	logf(logTypeAck, "Setting received for pn=%v min=%v", pn, p.min)
+	if pn < p.min {
+		// We've already forgotten about this one.
+		return
+	}
+
+	if pn >= p.min+uint64(p.max) {
+		// Forget the oldest packets to make room.
+		drop := pn - (p.min + uint64(p.max)) + 1
+		logf(logTypeAck, "Dropping %v packets from the start of the received packet window", drop)
+		if drop >= uint64(len(p.r)) {
+			p.r = p.r[:0]
+		} else {
+			p.r = append(p.r[:0], p.r[drop:]...)
+		}
+		p.min += drop
+	}
+
 	if pn >= p.min+uint64(len(p.r)) {
-		grow := (pn - p.min) - uint64(len(p.r))
+		grow := (pn - p.min) - uint64(len(p.r)) + 1
 		if grow < 10 {
 			grow = 10
 		}
+		if uint64(len(p.r))+grow > uint64(p.max) {
+			grow = uint64(p.max - len(p.r))
+		}
 
 		logf(logTypeAck, "Growing received packet window by %v", grow)
 		p.r = append(p.r, make([]bool, grow)...)
@@ -1100,6 +1694,16 @@ func (p *recvdPackets) init(pn uint64) {
 	p.acked2.init(pn)
 }
 
+func (p *recvdPackets) setMax(max int) {
+	// There has to be room for the packet being received.
+	if max < 1 {
+		max = 1
+	}
+	p.clear.max = max
+	p.all.max = max
+	p.acked2.max = max
+}
+
 func (p *recvdPackets) packetNotReceived(pn uint64) bool {
 	return p.clear.packetNotReceived(pn) && p.all.packetNotReceived(pn)
 }
@@ -1130,7 +1734,7 @@ func (p *recvdPackets) prepareAckRange(protected bool) []ackRange {
 	ranges := make([]ackRange, 0)
 	for i := len(ps.r) - 1; i >= 0; i-- {
 		pn = uint64(i) + ps.min
-		needs_ack := ps.r[i] && !p.acked2.r[i]
+		needs_ack := ps.r[i] && !p.acked2.isSet(pn)
 		if inrange != needs_ack {
 			if inrange {
 				// This is the end of a range.
@@ -1151,11 +1755,88 @@ func (p *recvdPackets) prepareAckRange(protected bool) []ackRange {
 	return ranges
 }
 
+// Drive a client connection until the handshake completes, reading
+// packets from the transport, which must be a ReadTransport. Returns
+// early if the connection fails or |ctx| is done. Cancellation is
+// only noticed when a packet arrives or the connection's timer
+// fires.
+func (c *Connection) Connect(ctx context.Context) error {
+	if c.role != RoleClient {
+		return fmt.Errorf("Connect() called on a server connection")
+	}
+	rt, ok := c.transport.(ReadTransport)
+	if !ok {
+		return fmt.Errorf("Connect() needs a ReadTransport")
+	}
+
+	if c.state == StateInit {
+		_, err := c.CheckTimer()
+		if err != nil {
+			return err
+		}
+	}
+
+	for c.state != StateEstablished {
+		if c.isClosed() {
+			return ErrorConnIsClosed
+		}
+		err := ctx.Err()
+		if err != nil {
+			return err
+		}
+
+		deadline, _ := ctx.Deadline()
+		err = c.pump(rt, deadline)
+		if err != nil && err != ErrorWouldBlock {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Wait for a packet from |rt| and process it, or run CheckTimer() if
+// the timer expires first. Returns ErrorWouldBlock if |deadline|
+// passes first; a zero deadline means no limit.
+func (c *Connection) pump(rt ReadTransport, deadline time.Time) error {
+	wait := c.NextTimerExpiry()
+	if !deadline.IsZero() && (wait.IsZero() || deadline.Before(wait)) {
+		wait = deadline
+	}
+
+	p, err := rt.Read(wait)
+	if err == ErrorWouldBlock {
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return ErrorWouldBlock
+		}
+		_, err = c.CheckTimer()
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	err = c.Input(p)
+	if errors.Is(err, ErrorFatal) {
+		return err
+	}
+	if err != nil {
+		logf(logTypeConnection, "%s: Dropping packet: %v", c.label(), err)
+	}
+	return nil
+}
+
 // Check the connection's timer and process any events whose time has
 // expired in the meantime. This includes sending retransmits, etc.
 func (c *Connection) CheckTimer() (int, error) {
 	logf(logTypeConnection, "Checking timer")
-	// Right now just re-send everything we might need to send.
+
+	if c.state == StateWaitServerFirstFlight || c.state == StateWaitClientSecondFlight {
+		err := c.checkHandshakeStall()
+		if err != nil {
+			return 0, err
+		}
+	}
 
 	// Special case the client's first message.
 	if c.role == RoleClient && (c.state == StateInit ||
@@ -1164,25 +1845,270 @@ func (c *Connection) CheckTimer() (int, error) {
 		return 1, err
 	}
 
+	c.handleLostPackets(c.loss.TimerExpired(c.rtt))
+
+	err := c.resetIdleStreams()
+	if err != nil {
+		return 0, err
+	}
+
+	err = c.probeMTU()
+	if err != nil {
+		return 0, err
+	}
+
 	return c.sendQueued(false)
 }
 
+// Stop waiting for packets that the loss detector says are lost.
+// Forgetting a packet is all it takes, because a chunk that isn't in
+// flight is sent again by the next sendQueued().
+func (c *Connection) handleLostPackets(lost []uint64) {
+	now := time.Now()
+	for _, pn := range lost {
+		if _, ok := c.sentPackets[pn]; !ok {
+			continue
+		}
+		logf(logTypeConnection, "%s: Packet %v lost", c.label(), pn)
+		delete(c.sentPackets, pn)
+		if c.carriesData(pn) {
+			c.lostPackets[pn] = now
+		}
+	}
+
+	// An ACK that arrives this late is too late to say that the
+	// retransmission was spurious.
+	for pn, t := range c.lostPackets {
+		if now.Sub(t) > c.rtt.retransmitInterval() {
+			delete(c.lostPackets, pn)
+		}
+	}
+}
+
+// Whether packet |pn| has stream data in it that hasn't been
+// acknowledged.
+func (c *Connection) carriesData(pn uint64) bool {
+	for _, s := range c.streams {
+		for _, ch := range s.out {
+			for _, p := range ch.pns {
+				if p == pn {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Count a timer expiry during the handshake. If the peer hasn't made
+// progress for kHandshakeStallTimeouts expiries, the path might be
+// dropping our larger packets, so go down to the minimum MTU. If
+// that doesn't help either, give up. Calls before the retransmit
+// interval has passed since the last send don't count.
+func (c *Connection) checkHandshakeStall() error {
+	if time.Since(c.lastSend) < c.rtt.retransmitInterval() {
+		return nil
+	}
+	c.stallTimeouts++
+	if c.stallTimeouts < kHandshakeStallTimeouts {
+		return nil
+	}
+
+	c.stallTimeouts = 0
+	if c.mtu > kMinimumMTU {
+		logf(logTypeConnection, "%s: Handshake stalled, reducing MTU %v -> %v", c.label(), c.mtu, kMinimumMTU)
+		c.mtu = kMinimumMTU
+		return nil
+	}
+
+	logf(logTypeConnection, "%s: Handshake stalled at the minimum MTU", c.label())
+	c.setState(StateError)
+	return ErrorHandshakeStalled
+}
+
+// Look for a bigger MTU by sending a PING padded to the next size up.
+// An ACK for the probe raises the MTU. If the probe isn't
+// acknowledged within the retransmit interval, or the transport
+// refuses to send it, the search stops at the current size.
+func (c *Connection) probeMTU() error {
+	if c.state != StateEstablished {
+		return nil
+	}
+	interval := c.rtt.retransmitInterval()
+	if c.mtuProbeSize != 0 {
+		if time.Since(c.mtuProbeSent) < interval {
+			return nil
+		}
+		logf(logTypeConnection, "%s: MTU probe of %v lost, staying at %v", c.label(), c.mtuProbeSize, c.mtu)
+		c.mtuMax = c.mtu
+		c.mtuProbeSize = 0
+	}
+	if c.mtu >= c.mtuMax || time.Since(c.mtuProbeSent) < interval {
+		return nil
+	}
+
+	size := c.mtu + kMTUProbeStep
+	if size > c.mtuMax {
+		size = c.mtuMax
+	}
+	ping := newPingFrame()
+	_, err := ping.length()
+	if err != nil {
+		return err
+	}
+	// The rest is PADDING frames, which are a single zero byte.
+	payload := make([]byte, size-kLongHeaderLength-c.writeProtected.aead.Overhead())
+	copy(payload, ping.encoded)
+
+	logf(logTypeConnection, "%s: Probing MTU of %v", c.label(), size)
+	pn := c.nextSendPacket
+	err = c.sendPacketSized(packetType1RTTProtectedPhase0, payload, size)
+	if errors.Is(err, syscall.EMSGSIZE) {
+		logf(logTypeConnection, "%s: MTU probe of %v too big, staying at %v", c.label(), size, c.mtu)
+		c.mtuMax = c.mtu
+		return nil
+	}
+	if err != nil {
+		// Don't try again until the interval has passed.
+		c.mtuProbeSent = time.Now()
+		return c.handleSendError(err)
+	}
+	c.packetSent(pn, false)
+	c.mtuProbeSize = size
+	c.mtuProbePN = pn
+	c.mtuProbeSent = time.Now()
+	return nil
+}
+
+// Reset streams that have had no data sent or received for too long.
+func (c *Connection) resetIdleStreams() error {
+	if c.streamIdle == 0 || c.state != StateEstablished {
+		return nil
+	}
+
+	now := time.Now()
+	for i := 1; i < len(c.streams); i++ {
+		s := c.streams[i]
+		if !s.idleResettable() || now.Sub(s.lastActive) < c.streamIdle {
+			continue
+		}
+		logf(logTypeConnection, "%s: Stream %v idle since %v, resetting", c.label(), s.id, s.lastActive)
+		err := c.resetStream(s, kQuicErrorCancelled)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Send RST_STREAM for |s| and drop anything buffered on it.
+// TODO(ekr@rtfm.com): RST_STREAM isn't retransmitted if it's lost.
+func (c *Connection) resetStream(s *Stream, code ErrorCode) error {
+	f := newRstStreamFrame(s.id, code, s.writeOffset)
+	err := c.sendPacket(packetType1RTTProtectedPhase0, []frame{f})
+	if err != nil {
+		return err
+	}
+	s.resetLocal = true
+	s.in = nil
+	s.out = nil
+	return nil
+}
+
+// Count the bytes on all streams that have been received but can't be
+// read yet because of a gap in front of them.
+func (c *Connection) bufferedBytes() (n int) {
+	for i := range c.streams {
+		n += c.streams[i].bufferedBytes()
+	}
+	return
+}
+
+// Close the connection with FLOW_CONTROL_ERROR if the peer makes us
+// buffer more than |n| bytes of out of order data across all streams.
+// This bounds the memory a peer can tie up by leaving gaps. Zero, the
+// default, means no limit.
+func (c *Connection) SetBufferLimit(n int) {
+	c.bufferLimit = n
+}
+
+// Reset streams which have been idle for longer than |d|. Zero, the
+// default, means never.
+func (c *Connection) SetStreamIdleTimeout(d time.Duration) {
+	c.streamIdle = d
+}
+
+// Return the time at which CheckTimer() next needs to be called. A
+// zero time means that there is nothing to retransmit and the
+// application need not set a timer until it calls Input() or
+// writes to a stream again.
+func (c *Connection) NextTimerExpiry() time.Time {
+	if c.isClosed() {
+		return time.Time{}
+	}
+
+	// The client's first message goes through CheckTimer().
+	if c.role == RoleClient {
+		switch c.state {
+		case StateInit:
+			return time.Now()
+		case StateWaitServerFirstFlight:
+			return c.lastSend.Add(c.rtt.retransmitInterval())
+		}
+	}
+
+	var next time.Time
+	if c.outstandingQueuedBytes() > 0 {
+		next = c.loss.NextTimer(c.rtt)
+		if next.IsZero() && c.addressValidated {
+			// Nothing is in flight, say because the transport had
+			// no buffers, so try again after a while. Data held
+			// back until the address is validated waits for the
+			// peer instead.
+			next = c.lastSend.Add(c.rtt.retransmitInterval())
+		}
+	}
+	if c.state == StateEstablished && (c.mtuProbeSize != 0 || c.mtu < c.mtuMax) {
+		probe := c.mtuProbeSent.Add(c.rtt.retransmitInterval())
+		if next.IsZero() || probe.Before(next) {
+			next = probe
+		}
+	}
+	if c.streamIdle != 0 && c.state == StateEstablished {
+		for i := 1; i < len(c.streams); i++ {
+			s := c.streams[i]
+			if !s.idleResettable() {
+				continue
+			}
+			idle := s.lastActive.Add(c.streamIdle)
+			if next.IsZero() || idle.Before(next) {
+				next = idle
+			}
+		}
+	}
+	return next
+}
+
 // Called when the handshake is complete.
 func (c *Connection) handshakeComplete() (err error) {
-	var sendLabel, recvLabel string
+	var sendLabel, recvLabel, sendUpdateLabel, recvUpdateLabel string
 	if c.role == RoleClient {
 		sendLabel = clientPpSecretLabel
 		recvLabel = serverPpSecretLabel
+		sendUpdateLabel = clientPpUpdateLabel
+		recvUpdateLabel = serverPpUpdateLabel
 	} else {
 		sendLabel = serverPpSecretLabel
 		recvLabel = clientPpSecretLabel
+		sendUpdateLabel = serverPpUpdateLabel
+		recvUpdateLabel = clientPpUpdateLabel
 	}
 
-	c.writeProtected, err = newCryptoState(c.tls, sendLabel)
+	c.writeProtected, err = newCryptoState(c.tls, sendLabel, sendUpdateLabel)
 	if err != nil {
 		return
 	}
-	c.readProtected, err = newCryptoState(c.tls, recvLabel)
+	c.readProtected, err = newCryptoState(c.tls, recvLabel, recvUpdateLabel)
 	if err != nil {
 		return
 	}
@@ -1195,6 +2121,25 @@ func (c *Connection) packetNonce(pn uint64) []byte {
 	return encodeArgs(pn)
 }
 
+// Send |data| on a new stream and close it, leaving the stream
+// open to read the peer's response. This suits simple
+// request/response protocols.
+func (c *Connection) SendMessage(data []byte) (*Stream, error) {
+	if c.isClosed() {
+		return nil, ErrorConnIsClosed
+	}
+	s := c.CreateStream()
+	_, err := s.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = s.Close()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
 // Create a stream on a given connection. Returns the created
 // stream.
 func (c *Connection) CreateStream() *Stream {
@@ -1211,7 +2156,12 @@ func (c *Connection) CreateStream() *Stream {
 		}
 	}
 
-	return c.ensureStream(nextStream)
+	s := c.ensureStream(nextStream)
+	c.maxStream = nextStream
+	if c.tracer != nil {
+		c.tracer.StreamOpened(c, s)
+	}
+	return s
 }
 
 // Get the stream with stream id |id|. Returns nil if no such
@@ -1223,13 +2173,13 @@ func (c *Connection) GetStream(id uint32) *Stream {
 		return nil
 	}
 
-	return &c.streams[iid]
+	return c.streams[iid]
 }
 
-func generateRand64() (uint64, error) {
+func generateRand64(random io.Reader) (uint64, error) {
 	b := make([]byte, 8)
 
-	_, err := rand.Read(b)
+	_, err := io.ReadFull(random, b)
 	if err != nil {
 		return 0, err
 	}
@@ -1243,24 +2193,228 @@ func generateRand64() (uint64, error) {
 	return ret, nil
 }
 
+// Set the number of ACK-eliciting packets that can be received
+// before an ACK is sent immediately rather than waiting for other
+// data to send.
+func (c *Connection) SetAckThreshold(n int) {
+	c.ackThreshold = n
+}
+
+// Set the largest stream ID that the peer can open. The connection
+// is closed with STREAM_ID_ERROR if the peer goes beyond it. The
+// default is 1000. Nothing tells the peer about this limit, because
+// there is no transport parameter or MAX_STREAM_ID frame for it here,
+// so it can't know to stay under it.
+func (c *Connection) SetMaxRemoteStreamId(id uint32) {
+	c.maxRemoteStream = id
+}
+
+// Set the number of received packets the connection keeps track
+// of. This bounds the memory used for generating ACKs; packets
+// older than this are treated as duplicates. Values below 1 are
+// treated as 1.
+func (c *Connection) SetMaxTrackedPackets(n int) {
+	c.recvd.setMax(n)
+}
+
 // Set the handler class for a given connection.
 func (c *Connection) SetHandler(h ConnectionHandler) {
 	c.handler = h
 }
 
+// Move to the next generation of send keys. The peer follows when it
+// sees the flipped key phase bit. Only one update can be outstanding
+// at a time.
+func (c *Connection) InitiateKeyUpdate() error {
+	if c.state != StateEstablished {
+		return ErrorWouldBlock
+	}
+	if c.writePhase != c.readPhase {
+		return fmt.Errorf("Key update already in progress")
+	}
+
+	return c.updateWriteKeys()
+}
+
+func (c *Connection) updateWriteKeys() error {
+	next, err := c.writeProtected.next()
+	if err != nil {
+		return err
+	}
+	logf(logTypeConnection, "%s: Updating send keys", c.label())
+	c.writeProtected = next
+	c.writePhase = flipKeyPhase(c.writePhase)
+	c.keyPackets = 0
+	return nil
+}
+
+// Update the send keys automatically after |n| packets have been
+// protected with them. The default is the AEAD confidentiality limit
+// for AES-GCM. Zero means never.
+func (c *Connection) SetKeyUpdateLimit(n uint64) {
+	c.keyUpdateLimit = n
+}
+
+// Install the next read keys once a packet has been decrypted with
+// them. The current keys are kept for packets reordered across the
+// update. If the peer initiated the update, follow it.
+func (c *Connection) updateReadKeys(next *cryptoState, pn uint64) error {
+	logf(logTypeConnection, "%s: Updating receive keys at PN=%v", c.label(), pn)
+	c.readPrevious = c.readProtected
+	c.readProtected = next
+	c.readPhase = flipKeyPhase(c.readPhase)
+	c.readPhaseStart = pn
+
+	if c.writePhase != c.readPhase {
+		return c.updateWriteKeys()
+	}
+	return nil
+}
+
+func flipKeyPhase(phase uint8) uint8 {
+	if phase == packetType1RTTProtectedPhase0 {
+		return packetType1RTTProtectedPhase1
+	}
+	return packetType1RTTProtectedPhase0
+}
+
+// Whether the peer's address has been validated. A server doesn't
+// know this until the client echoes its connection ID, and until then
+// it holds back anything over the anti-amplification limit. There is
+// only one path, so clients are always validated.
+func (c *Connection) PathValidated() bool {
+	return c.addressValidated
+}
+
+// Get the time taken to establish the connection. For a client
+// this runs from sending the first packet, and for a server from
+// receiving it. Zero until the connection is established.
+func (c *Connection) HandshakeDuration() time.Duration {
+	return c.handshakeTime
+}
+
+// Whether the client had to start the handshake again, which costs
+// a round trip. This happens after version negotiation.
+func (c *Connection) HandshakeRestarted() bool {
+	return c.restarted
+}
+
+// Statistics about a connection.
+type ConnectionStats struct {
+	RttStats
+	MTU      int // The largest packet that will be sent.
+	Buffered int // Bytes received out of order and not readable yet.
+	// Packets declared lost that were acknowledged afterwards. A lot
+	// of these means that the path reorders more than loss detection
+	// allows for.
+	SpuriousRetransmits int
+}
+
+// Get the current round trip time estimates, MTU, buffer usage and
+// loss detection statistics.
+func (c *Connection) Stats() ConnectionStats {
+	return ConnectionStats{c.rtt, c.mtu, c.bufferedBytes(), c.spurious}
+}
+
+// Use |d| to decide when packets are lost, instead of the default
+// detector, which follows draft-ietf-quic-recovery. Packets that were
+// sent before this is called are never declared lost, so call it
+// before the connection sends anything.
+func (c *Connection) SetLossDetector(d LossDetector) {
+	c.loss = d
+}
+
+// Set a tracer for a given connection. Note that a server
+// connection has already received the ClientInitial by the
+// time ServerHandler.NewConnection() is called, so the tracer
+// won't see HandshakeStarted.
+func (c *Connection) SetTracer(t Tracer) {
+	c.tracer = t
+}
+
+// Send CONNECTION_CLOSE. Any ACKs we owe go out first, so that the
+// peer doesn't retransmit data we already have while it closes.
 func (c *Connection) close(code ErrorCode, reason string) {
+	if c.state == StateEstablished {
+		c.sendQueuedStreams(packetType1RTTProtectedPhase0, nil, true, true)
+	}
 	f := newConnectionCloseFrame(code, reason)
 	c.sendPacket(packetType1RTTProtectedPhase0, []frame{f})
 }
 
+// Close the connection because of a protocol error and return
+// the error for the caller to pass up.
+func (c *Connection) closeWithError(code ErrorCode, err error) error {
+	c.close(code, err.Error())
+	c.setState(StateClosed)
+	return &QuicError{code, err}
+}
+
+// Give up on a handshake that TLS has rejected. Fatal errors are
+// reported to the peer in a cleartext CONNECTION_CLOSE, because there
+// might not be any 1-RTT keys yet, and the connection moves to
+// StateError. Anything else is passed through untouched.
+func (c *Connection) handshakeFailed(err error) error {
+	if !errors.Is(err, ErrorFatal) {
+		return err
+	}
+
+	code := kQuicErrorTlsHandshakeFailed
+	var ae *tlsAlertError
+	if errors.As(err, &ae) {
+		code = kQuicErrorTlsFatalAlertGenerated
+	}
+
+	pt := uint8(packetTypeClientCleartext)
+	if c.role == RoleServer {
+		pt = packetTypeServerCleartext
+	}
+	f := newConnectionCloseFrame(code, err.Error())
+	c.sendPacket(pt, []frame{f})
+	c.setState(StateError)
+	return &QuicError{code, err}
+}
+
 // Close a connection.
 func (c *Connection) Close() {
 	logf(logTypeConnection, "%v Close()", c.label())
 	c.close(kQuicErrorNoError, "You don't have to go home but you can't stay here")
+	c.setState(StateClosed)
+}
+
+// Close a connection with an error code of the application's
+// choosing. Fails if the code is outside the application's range.
+func (c *Connection) CloseWithError(code ApplicationError, reason string) error {
+	logf(logTypeConnection, "%v CloseWithError(0x%x)", c.label(), uint32(code))
+	if c.isClosed() {
+		return ErrorConnIsClosed
+	}
+	ec, err := code.errorCode()
+	if err != nil {
+		return err
+	}
+	c.close(ec, reason)
+	c.setState(StateClosed)
+	return nil
+}
+
+// Close a connection immediately without sending anything, and
+// release its state. The peer isn't told, so it will have to time
+// out. This is for tests and for aborting when the connection can't
+// continue at all; use Close() otherwise.
+func (c *Connection) Kill() {
+	logf(logTypeConnection, "%v Kill()", c.label())
+	c.setState(StateClosed)
+	c.streams = nil
+	c.clientInitial = nil
+	c.sentAcks = make(map[uint64][]ackRange)
+	c.sentPackets = make(map[uint64]sentPacket)
+	c.lostPackets = make(map[uint64]time.Time)
+	c.recvd = newRecvdPackets()
 }
 
 func (c *Connection) isClosed() bool {
-	return c.state == StateClosed
+	return c.state == StateClosed || c.state == StateError
 }
 
 // Get the current state of a connection.
@@ -1,10 +1,18 @@
 package minq
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"syscall"
 	"testing"
+	"time"
 )
 
+// The test server has a self-signed certificate.
+var testTlsConfig = TlsConfig{InsecureSkipVerify: true}
+
 type testPacket struct {
 	b []byte
 }
@@ -65,6 +73,19 @@ func (t *testTransport) Recv() ([]byte, error) {
 	return p.b, nil
 }
 
+// A transport which fails every send with |err|, if set.
+type testErrorTransport struct {
+	testTransport
+	err error
+}
+
+func (t *testErrorTransport) Send(p []byte) error {
+	if t.err != nil {
+		return t.err
+	}
+	return t.testTransport.Send(p)
+}
+
 func newTestTransportPair(autoFlush bool) (a, b *testTransport) {
 	a2b := newTestTransportPipe(autoFlush)
 	b2a := newTestTransportPipe(autoFlush)
@@ -103,10 +124,10 @@ type csPair struct {
 func newCsPair(t *testing.T) *csPair {
 	cTrans, sTrans := newTestTransportPair(true)
 
-	client := NewConnection(cTrans, RoleClient, TlsConfig{}, nil)
+	client := NewConnection(cTrans, RoleClient, testTlsConfig, nil)
 	assertNotNil(t, client, "Couldn't make client")
 
-	server := NewConnection(sTrans, RoleServer, TlsConfig{}, nil)
+	server := NewConnection(sTrans, RoleServer, testTlsConfig, nil)
 	assertNotNil(t, server, "Couldn't make server")
 
 	return &csPair{
@@ -131,7 +152,7 @@ func (pair *csPair) handshake(t *testing.T) {
 func TestSendCI(t *testing.T) {
 	cTrans, _ := newTestTransportPair(true)
 
-	client := NewConnection(cTrans, RoleClient, TlsConfig{}, nil)
+	client := NewConnection(cTrans, RoleClient, testTlsConfig, nil)
 	assertNotNil(t, client, "Couldn't make client")
 
 	err := client.sendClientInitial()
@@ -141,10 +162,10 @@ func TestSendCI(t *testing.T) {
 func TestSendReceiveCI(t *testing.T) {
 	cTrans, sTrans := newTestTransportPair(true)
 
-	client := NewConnection(cTrans, RoleClient, TlsConfig{}, nil)
+	client := NewConnection(cTrans, RoleClient, testTlsConfig, nil)
 	assertNotNil(t, client, "Couldn't make client")
 
-	server := NewConnection(sTrans, RoleServer, TlsConfig{}, nil)
+	server := NewConnection(sTrans, RoleServer, testTlsConfig, nil)
 	assertNotNil(t, server, "Couldn't make server")
 
 	err := client.sendClientInitial()
@@ -158,10 +179,10 @@ func TestSendReceiveCI(t *testing.T) {
 func TestSendReceiveDupCI(t *testing.T) {
 	cTrans, sTrans := newTestTransportPair(true)
 
-	client := NewConnection(cTrans, RoleClient, TlsConfig{}, nil)
+	client := NewConnection(cTrans, RoleClient, testTlsConfig, nil)
 	assertNotNil(t, client, "Couldn't make client")
 
-	server := NewConnection(sTrans, RoleServer, TlsConfig{}, nil)
+	server := NewConnection(sTrans, RoleServer, testTlsConfig, nil)
 	assertNotNil(t, server, "Couldn't make server")
 
 	err := client.sendClientInitial()
@@ -174,17 +195,24 @@ func TestSendReceiveDupCI(t *testing.T) {
 	assertNotError(t, err, "Couldn't check timer on client")
 	assertEquals(t, n, 1)
 
+	// Lose the server's first flight.
+	cTrans.r.out = nil
 	err = inputAll(server)
 	assertNotError(t, err, "Error processing second CI")
+
+	// The server resends in response to the second CI.
+	err = inputAll(client)
+	assertNotError(t, err, "Error processing resent SH")
+	assertEquals(t, StateEstablished, client.GetState())
 }
 
 func TestSendReceiveCISI(t *testing.T) {
 	cTrans, sTrans := newTestTransportPair(true)
 
-	client := NewConnection(cTrans, RoleClient, TlsConfig{}, nil)
+	client := NewConnection(cTrans, RoleClient, testTlsConfig, nil)
 	assertNotNil(t, client, "Couldn't make client")
 
-	server := NewConnection(sTrans, RoleServer, TlsConfig{}, nil)
+	server := NewConnection(sTrans, RoleServer, testTlsConfig, nil)
 	assertNotNil(t, server, "Couldn't make server")
 
 	err := client.sendClientInitial()
@@ -274,15 +302,157 @@ func TestSendReceiveData(t *testing.T) {
 	assertEquals(t, pair.server.GetState(), StateClosed)
 }
 
+func TestHandshakeBlackHole(t *testing.T) {
+	pair := newCsPair(t)
+	// The path drops anything bigger than the minimum MTU.
+	pipe := pair.client.transport.(*testTransport).w
+	dropLarge := func() {
+		var kept []*testPacket
+		for _, p := range pipe.out {
+			if len(p.b) <= kMinimumMTU {
+				kept = append(kept, p)
+			}
+		}
+		pipe.out = kept
+	}
+
+	_, err := pair.client.CheckTimer()
+	assertNotError(t, err, "Couldn't send client initial")
+	for i := 0; pair.client.GetState() != StateEstablished; i++ {
+		assertX(t, i <= kHandshakeStallTimeouts, "Handshake didn't recover")
+		dropLarge()
+		err = inputAll(pair.server)
+		assertNotError(t, err, "Error processing client packets")
+		err = inputAll(pair.client)
+		assertNotError(t, err, "Error processing server packets")
+		if pair.client.GetState() == StateWaitServerFirstFlight {
+			pair.client.lastSend = time.Now().Add(-kRetransmitInterval)
+			_, err = pair.client.CheckTimer()
+			assertNotError(t, err, "Couldn't resend client initial")
+		}
+	}
+	assertEquals(t, kMinimumMTU, pair.client.mtu)
+}
+
+func TestHandshakeStalled(t *testing.T) {
+	pair := newCsPair(t)
+	pipe := pair.client.transport.(*testTransport).w
+
+	// Polling before the timer is due doesn't count.
+	for i := 0; i < 3*kHandshakeStallTimeouts; i++ {
+		_, err := pair.client.CheckTimer()
+		assertNotError(t, err, "Gave up early")
+	}
+	assertEquals(t, kInitialMTU, pair.client.mtu)
+
+	var err error
+	for i := 0; err == nil; i++ {
+		assertX(t, i <= 2*kHandshakeStallTimeouts, "Handshake never gave up")
+		pipe.out = nil
+		pair.client.lastSend = time.Now().Add(-kRetransmitInterval)
+		_, err = pair.client.CheckTimer()
+	}
+	assertEquals(t, ErrorHandshakeStalled, err)
+	assertX(t, errors.Is(err, ErrorFatal), "Expected a fatal error")
+	assertEquals(t, StateError, pair.client.GetState())
+	assertEquals(t, kMinimumMTU, pair.client.mtu)
+}
+
+func TestAmplificationLimit(t *testing.T) {
+	pair := newCsPair(t)
+	// A small MTU makes for a small ClientInitial.
+	pair.client.mtu = 500
+
+	err := pair.client.sendClientInitial()
+	assertNotError(t, err, "Couldn't send client initial packet")
+	cpipe := pair.client.transport.(*testTransport).w
+	ci := len(cpipe.out[0].b)
+
+	pn := pair.server.nextSendPacket
+	err = inputAll(pair.server)
+	assertNotError(t, err, "Couldn't read client initial")
+	sent := 0
+	spipe := pair.server.transport.(*testTransport).w
+	for _, p := range spipe.out {
+		sent += len(p.b)
+	}
+	// Held packets don't use packet numbers or count as sent.
+	assertEquals(t, pn+uint64(len(spipe.out)), pair.server.nextSendPacket)
+	for _, chunk := range pair.server.streams[0].out {
+		for _, p := range chunk.pns {
+			_, ok := pair.server.sentPackets[p]
+			assertX(t, ok, "Chunk is in a packet that wasn't sent")
+		}
+	}
+	for p := range pair.server.sentAcks {
+		assertX(t, p < pair.server.nextSendPacket, "ACKs are in a packet that wasn't sent")
+	}
+	assertX(t, sent > 0, "Server sent nothing")
+	assertX(t, sent <= kAmplificationFactor*ci, "Server sent too much")
+	flight := 0
+	for _, chunk := range pair.server.streams[0].out {
+		flight += len(chunk.data)
+	}
+	assertX(t, sent < flight, "Whole flight was sent")
+	assertX(t, !pair.server.PathValidated(), "Server validated too early")
+	assertX(t, pair.client.PathValidated(), "Client isn't validated")
+
+	// Once the client responds, the rest of the flight is released.
+	for pair.server.GetState() != StateEstablished {
+		err = inputAll(pair.client)
+		assertNotError(t, err, "Error processing server flight")
+		err = inputAll(pair.server)
+		assertNotError(t, err, "Error processing client flight")
+	}
+	assertEquals(t, StateEstablished, pair.client.GetState())
+	assertEquals(t, StateEstablished, pair.server.GetState())
+	assertX(t, pair.server.PathValidated(), "Server never validated")
+}
+
+func TestDataWithFinished(t *testing.T) {
+	pair := newCsPair(t)
+
+	// Queue data before there are any 1-RTT keys.
+	cs := pair.client.CreateStream()
+	cs.Write([]byte("early"))
+
+	err := pair.client.sendClientInitial()
+	assertNotError(t, err, "Couldn't send client initial packet")
+	err = inputAll(pair.server)
+	assertNotError(t, err, "Couldn't read client initial")
+
+	pipe := pair.client.transport.(*testTransport).w
+	pipe.out = nil
+	err = inputAll(pair.client)
+	assertNotError(t, err, "Couldn't read server flight")
+	assertEquals(t, StateEstablished, pair.client.GetState())
+
+	// The flight ends with the Finished, with the data right behind
+	// it. Anything before that is ACKs.
+	n := len(pipe.out)
+	assertX(t, n >= 2, "Not enough packets sent")
+	var hdr packetHeader
+	_, err = decode(&hdr, pipe.out[n-2].b)
+	assertNotError(t, err, "Couldn't decode header")
+	assertX(t, !hdr.isProtected(), "Finished wasn't in cleartext")
+	_, err = decode(&hdr, pipe.out[n-1].b)
+	assertNotError(t, err, "Couldn't decode header")
+	assertX(t, hdr.isProtected(), "Data wasn't protected")
+
+	err = inputAll(pair.server)
+	assertNotError(t, err, "Couldn't read client flight")
+	assertByteEquals(t, []byte("early"), pair.server.GetStream(1).readAll())
+}
+
 func TestVersionNegotiationPacket(t *testing.T) {
 	cTrans, sTrans := newTestTransportPair(true)
 
-	client := NewConnection(cTrans, RoleClient, TlsConfig{}, nil)
+	client := NewConnection(cTrans, RoleClient, testTlsConfig, nil)
 	assertNotNil(t, client, "Couldn't make client")
 	// Set the client version to something bogus.
 	client.version = kQuicGreaseVersion2
 
-	server := NewConnection(sTrans, RoleServer, TlsConfig{}, nil)
+	server := NewConnection(sTrans, RoleServer, testTlsConfig, nil)
 	assertNotNil(t, server, "Couldn't make server")
 
 	err := client.sendClientInitial()
@@ -291,9 +461,1232 @@ func TestVersionNegotiationPacket(t *testing.T) {
 	err = inputAll(server)
 	assertError(t, err, "Expected version negotiation error")
 	assertEquals(t, err, ErrorDestroyConnection)
+	assertX(t, errors.Is(err, ErrorFatal), "Expected a fatal error")
+
+	// The client picks the version we speak and starts again.
+	err = inputAll(client)
+	assertNotError(t, err, "Couldn't process version negotiation")
+	assertEquals(t, kQuicVersion, client.version)
+	assertEquals(t, StateWaitServerFirstFlight, client.GetState())
+	assertX(t, client.HandshakeRestarted(), "Restart not recorded")
+
+	pair := &csPair{client, NewConnection(sTrans, RoleServer, testTlsConfig, nil)}
+	pair.handshake(t)
+	assertEquals(t, StateEstablished, client.GetState())
+
+	// Once the server has been heard from, version negotiation is
+	// ignored.
+	// Use a packet number that doesn't look like a duplicate.
+	err = pair.server.sendVersionNegotiation(&packetHeader{
+		Version:      client.version,
+		ConnectionID: client.clientConnId,
+		PacketNumber: pair.server.nextSendPacket,
+	})
+	assertNotError(t, err, "Couldn't send version negotiation")
+	err = inputAll(client)
+	assertNotError(t, err, "Version negotiation wasn't ignored")
+	assertEquals(t, StateEstablished, client.GetState())
+}
+
+func TestVersionNegotiationNoCommonVersion(t *testing.T) {
+	cTrans, sTrans := newTestTransportPair(true)
+
+	client := NewConnection(cTrans, RoleClient, testTlsConfig, nil)
+	client.version = kQuicGreaseVersion2
+	server := NewConnection(sTrans, RoleServer, testTlsConfig, nil)
+	server.version = kQuicGreaseVersion1
+
+	err := client.sendClientInitial()
+	assertNotError(t, err, "Couldn't send client initial packet")
+	inputAll(server)
 
 	err = inputAll(client)
 	assertError(t, err, "Expected version negotiation error")
 	assertEquals(t, err, ErrorReceivedVersionNegotiation)
+	assertX(t, errors.Is(err, ErrorFatal), "Expected a fatal error")
+	assertEquals(t, client.GetState(), StateClosed)
+
+	err = client.Input([]byte{0})
+	assertEquals(t, err, ErrorConnIsClosed)
+}
+
+func TestVersionNegotiationForged(t *testing.T) {
+	cTrans, sTrans := newTestTransportPair(true)
+
+	client := NewConnection(cTrans, RoleClient, testTlsConfig, nil)
+	server := NewConnection(sTrans, RoleServer, testTlsConfig, nil)
+
+	err := client.sendClientInitial()
+	assertNotError(t, err, "Couldn't send client initial packet")
+
+	// A version negotiation packet that doesn't echo our connection
+	// ID is ignored.
+	err = server.sendVersionNegotiation(&packetHeader{
+		Version:      client.version,
+		ConnectionID: client.clientConnId + 1,
+		PacketNumber: client.nextSendPacket - 1,
+	})
+	assertNotError(t, err, "Couldn't send version negotiation")
+	err = inputAll(client)
+	assertNotError(t, err, "Forged version negotiation wasn't ignored")
+	assertEquals(t, StateWaitServerFirstFlight, client.GetState())
+}
+
+func TestSendErrors(t *testing.T) {
+	cTrans, _ := newTestTransportPair(true)
+	trans := &testErrorTransport{*cTrans, syscall.ENOBUFS}
+
+	client := NewConnection(trans, RoleClient, testTlsConfig, nil)
+	assertNotNil(t, client, "Couldn't make client")
+
+	// Running out of buffers is transient.
+	_, err := client.CheckTimer()
+	assertNotError(t, err, "ENOBUFS should not be an error")
+	assertEquals(t, kInitialMTU, client.mtu)
+
+	// A packet that's too big shrinks the MTU.
+	trans.err = syscall.EMSGSIZE
+	_, err = client.CheckTimer()
+	assertNotError(t, err, "First EMSGSIZE should not be an error")
+	assertEquals(t, kMinimumMTU, client.mtu)
+
+	// But we can't go any smaller than the minimum.
+	_, err = client.CheckTimer()
+	assertError(t, err, "EMSGSIZE at the minimum MTU should be an error")
+
+	// Once the transport recovers, the smaller client initial goes out.
+	trans.err = nil
+	_, err = client.CheckTimer()
+	assertNotError(t, err, "Couldn't resend client initial")
+	p := cTrans.w.Recv()
+	assertNotNil(t, p, "Client initial wasn't sent")
+	assertEquals(t, kMinimumMTU, len(p.b))
+}
+
+func TestSendErrorBackoff(t *testing.T) {
+	cTrans, _ := newTestTransportPair(true)
+	trans := &testErrorTransport{*cTrans, syscall.ENOBUFS}
+	client := NewConnection(trans, RoleClient, testTlsConfig, nil)
+
+	// A ClientInitial that can't be sent is retried after the
+	// retransmit interval, not straight away, and doesn't count
+	// towards a stall.
+	for i := 0; i < 2*kHandshakeStallTimeouts; i++ {
+		_, err := client.CheckTimer()
+		assertNotError(t, err, "ENOBUFS should not be an error")
+	}
+	assertEquals(t, StateWaitServerFirstFlight, client.GetState())
+	assertX(t, client.NextTimerExpiry().After(time.Now()), "Timer is already due")
+}
+
+func TestStreamIdTooLarge(t *testing.T) {
+	pair := newCsPair(t)
+
+	pair.handshake(t)
+
+	// Have the client send data on a stream the server wouldn't allow.
+	f := newStreamFrame(kDefaultMaxRemoteStreamId+2, 0, []byte("abcdef"))
+	err := pair.client.sendPacket(packetType1RTTProtectedPhase0, []frame{f})
+	assertNotError(t, err, "Couldn't send stream frame")
+
+	err = inputAll(pair.server)
+	assertError(t, err, "Expected stream ID error")
+	var qerr *QuicError
+	assertX(t, errors.As(err, &qerr), "Expected a QuicError")
+	assertEquals(t, kQuicErrorStreamIdError, qerr.Code)
+	assertEquals(t, pair.server.GetState(), StateClosed)
+	assertX(t, len(pair.server.streams) <= kDefaultMaxRemoteStreamId, "Server created the stream")
+
+	// The client should see the close.
+	err = inputAll(pair.client)
+	assertNotError(t, err, "Couldn't read close")
+	assertEquals(t, pair.client.GetState(), StateClosed)
+}
+
+func TestMaxRemoteStreamId(t *testing.T) {
+	pair := newCsPair(t)
+	pair.server.SetMaxRemoteStreamId(kDefaultMaxRemoteStreamId + 10)
+	pair.handshake(t)
+
+	// A stream past the default is fine if the limit is higher.
+	f := newStreamFrame(kDefaultMaxRemoteStreamId+2, 0, []byte("abcdef"))
+	err := pair.client.sendPacket(packetType1RTTProtectedPhase0, []frame{f})
+	assertNotError(t, err, "Couldn't send stream frame")
+	err = inputAll(pair.server)
+	assertNotError(t, err, "Stream under the limit was refused")
+	assertX(t, pair.server.GetStream(kDefaultMaxRemoteStreamId+2) != nil, "Server didn't create the stream")
+
+	f = newStreamFrame(kDefaultMaxRemoteStreamId+12, 0, []byte("abcdef"))
+	err = pair.client.sendPacket(packetType1RTTProtectedPhase0, []frame{f})
+	assertNotError(t, err, "Couldn't send stream frame")
+	err = inputAll(pair.server)
+	var qerr *QuicError
+	assertX(t, errors.As(err, &qerr), "Expected a QuicError")
+	assertEquals(t, kQuicErrorStreamIdError, qerr.Code)
+}
+
+func TestTooManyFrames(t *testing.T) {
+	pair := newCsPair(t)
+	pair.handshake(t)
+	inputAll(pair.server)
+
+	// Lots of PADDING is fine.
+	padding := make([]frame, 500)
+	for i := range padding {
+		padding[i] = newPaddingFrame(0)
+	}
+	err := pair.client.sendPacket(packetType1RTTProtectedPhase0, padding)
+	assertNotError(t, err, "Couldn't send padding")
+	err = inputAll(pair.server)
+	assertNotError(t, err, "Padding was rejected")
+
+	pings := make([]frame, kMaxFramesPerPacket+1)
+	for i := range pings {
+		pings[i] = newPingFrame()
+	}
+	err = pair.client.sendPacket(packetType1RTTProtectedPhase0, pings)
+	assertNotError(t, err, "Couldn't send pings")
+	err = inputAll(pair.server)
+	var qerr *QuicError
+	assertX(t, errors.As(err, &qerr), "Expected a QuicError")
+	assertEquals(t, kQuicErrorProtocolViolation, qerr.Code)
+	assertEquals(t, StateClosed, pair.server.GetState())
+}
+
+func TestBufferLimit(t *testing.T) {
+	pair := newCsPair(t)
+	pair.handshake(t)
+	inputAll(pair.server)
+	pair.server.SetBufferLimit(1000)
+
+	// Leave a gap at the start of lots of streams.
+	data := make([]byte, 300)
+	for id := uint32(1); id <= 7; id += 2 {
+		f := newStreamFrame(id, 10, data)
+		err := pair.client.sendPacket(packetType1RTTProtectedPhase0, []frame{f})
+		assertNotError(t, err, "Couldn't send stream data")
+		err = inputAll(pair.server)
+		if id < 7 {
+			assertNotError(t, err, "Stream data was rejected")
+			assertEquals(t, int(id+1)/2*len(data), pair.server.Stats().Buffered)
+		} else {
+			var qerr *QuicError
+			assertX(t, errors.As(err, &qerr), "Expected a QuicError")
+			assertEquals(t, kQuicErrorFlowControlError, qerr.Code)
+		}
+	}
+	assertEquals(t, StateClosed, pair.server.GetState())
+}
+
+func TestAckThreshold(t *testing.T) {
+	pair := newCsPair(t)
+
+	pair.handshake(t)
+
+	// Finish the handshake and let the ACKs settle.
+	toClient := pair.client.transport.(*testTransport).r
+	toServer := pair.server.transport.(*testTransport).r
+	for len(toClient.out) > 0 || len(toServer.out) > 0 {
+		err := inputAll(pair.server)
+		assertNotError(t, err, "Error processing client packets")
+		err = inputAll(pair.client)
+		assertNotError(t, err, "Error processing server packets")
+	}
+
+	pair.server.SetAckThreshold(3)
+	var err error
+
+	cs := pair.client.CreateStream()
+	for i := 1; i < 3; i++ {
+		cs.Write([]byte("abcdef"))
+		err = inputAll(pair.server)
+		assertNotError(t, err, "Couldn't read data")
+		assertEquals(t, 0, len(toClient.out))
+	}
+
+	// The third packet tips it over.
+	cs.Write([]byte("abcdef"))
+	err = inputAll(pair.server)
+	assertNotError(t, err, "Couldn't read data")
+	assertEquals(t, 1, len(toClient.out))
+
+	err = inputAll(pair.client)
+	assertNotError(t, err, "Couldn't read ACK")
+	assertEquals(t, 0, pair.client.outstandingQueuedBytes())
+}
+
+func TestDuplicatePacketNotFatal(t *testing.T) {
+	cTrans, sTrans := newTestTransportPair(true)
+
+	client := NewConnection(cTrans, RoleClient, testTlsConfig, nil)
+	assertNotNil(t, client, "Couldn't make client")
+
+	server := NewConnection(sTrans, RoleServer, testTlsConfig, nil)
+	assertNotNil(t, server, "Couldn't make server")
+
+	err := client.sendClientInitial()
+	assertNotError(t, err, "Couldn't send client initial packet")
+
+	p, err := sTrans.Recv()
+	assertNotError(t, err, "Couldn't read client initial")
+
+	err = server.Input(p)
+	assertNotError(t, err, "Error processing CI")
+
+	err = server.Input(p)
+	assertError(t, err, "Expected duplicate packet error")
+	assertX(t, !errors.Is(err, ErrorFatal), "Duplicate shouldn't be fatal")
+	assertEquals(t, server.GetState(), StateWaitClientSecondFlight)
+}
+
+func TestHandshakeBadCertificate(t *testing.T) {
+	cTrans, sTrans := newTestTransportPair(true)
+
+	// Verify the server's certificate, which will fail.
+	client := NewConnection(cTrans, RoleClient, TlsConfig{}, nil)
+	assertNotNil(t, client, "Couldn't make client")
+
+	server := NewConnection(sTrans, RoleServer, testTlsConfig, nil)
+	assertNotNil(t, server, "Couldn't make server")
+
+	err := client.sendClientInitial()
+	assertNotError(t, err, "Couldn't send client initial packet")
+
+	err = inputAll(server)
+	assertNotError(t, err, "Error processing CI")
+
+	err = inputAll(client)
+	assertError(t, err, "Client should reject the certificate")
+	assertX(t, errors.Is(err, ErrorFatal), "Expected a fatal error")
+	assertEquals(t, client.GetState(), StateError)
+}
+
+type testTracer struct {
+	events []string
+}
+
+func (tr *testTracer) HandshakeStarted(c *Connection) {
+	tr.events = append(tr.events, "start")
+}
+
+func (tr *testTracer) HandshakeComplete(c *Connection) {
+	tr.events = append(tr.events, "established")
+}
+
+func (tr *testTracer) StreamOpened(c *Connection, s *Stream) {
+	tr.events = append(tr.events, fmt.Sprintf("stream %v", s.Id()))
+}
+
+func (tr *testTracer) ConnectionClosed(c *Connection) {
+	tr.events = append(tr.events, "closed")
+}
+
+func TestTracer(t *testing.T) {
+	pair := newCsPair(t)
+	ctr := &testTracer{}
+	pair.client.SetTracer(ctr)
+	str := &testTracer{}
+	pair.server.SetTracer(str)
+
+	pair.handshake(t)
+
+	cs := pair.client.CreateStream()
+	cs.Write([]byte("abcdef"))
+	err := inputAll(pair.server)
+	assertNotError(t, err, "Couldn't read input packets")
+
+	pair.client.Close()
+	err = inputAll(pair.server)
+	assertNotError(t, err, "Read close")
+
+	expected := "[start established stream 1 closed]"
+	assertEquals(t, expected, fmt.Sprintf("%v", ctr.events))
+	assertEquals(t, expected, fmt.Sprintf("%v", str.events))
+}
+
+func TestRecvdPacketsBounded(t *testing.T) {
+	p := newRecvdPackets()
+	p.setMax(100)
+	p.init(1000)
+
+	// Every other packet, so lots of ranges.
+	for pn := uint64(1000); pn < 2000; pn += 2 {
+		assertX(t, p.packetNotReceived(pn), "Packet shouldn't be received yet")
+		p.packetSetReceived(pn, true)
+		assertX(t, len(p.all.r) <= 100, "Tracking too many packets")
+	}
+	p.packetSetAcked2(1000)
+
+	ranges := p.prepareAckRange(true)
+	assertEquals(t, 50, len(ranges))
+	assertEquals(t, uint64(1998), ranges[0].lastPacket)
+
+	// Old packets are treated as duplicates.
+	assertX(t, !p.packetNotReceived(1002), "Old packet should look received")
+	assertX(t, p.packetNotReceived(1997), "Recent gap should be open")
+}
+
+func TestRecvdPacketsMinimum(t *testing.T) {
+	for _, max := range []int{0, -1} {
+		p := newRecvdPackets()
+		p.setMax(max)
+		p.init(1000)
+		for pn := uint64(1000); pn < 1005; pn++ {
+			assertX(t, p.packetNotReceived(pn), "Packet shouldn't be received yet")
+			p.packetSetReceived(pn, true)
+		}
+		assertX(t, !p.packetNotReceived(1004), "Latest packet should look received")
+	}
+}
+
+func TestNextTimerExpiry(t *testing.T) {
+	pair := newCsPair(t)
+
+	// The client initial should go out right away.
+	assertX(t, !pair.client.NextTimerExpiry().After(time.Now()), "Client initial not due")
+	assertX(t, pair.server.NextTimerExpiry().IsZero(), "Server has a timer before any input")
+
+	_, err := pair.client.CheckTimer()
+	assertNotError(t, err, "Couldn't send client initial")
+	assertX(t, pair.client.NextTimerExpiry().After(time.Now()), "Client initial due again immediately")
+
+	pair.handshake(t)
+
+	// Unacknowledged data means a retransmission timer.
+	cs := pair.client.CreateStream()
+	cs.Write([]byte("abcdef"))
+	assertX(t, !pair.client.NextTimerExpiry().IsZero(), "No timer with data outstanding")
+
+	pair.client.Close()
+	assertX(t, pair.client.NextTimerExpiry().IsZero(), "Closed connection has a timer")
+}
+
+func TestKeyUpdate(t *testing.T) {
+	pair := newCsPair(t)
+	pair.handshake(t)
+
+	// Force the client to get the ACK from the server
+	pair.server.CheckTimer()
+	err := inputAll(pair.client)
+	assertNotError(t, err, "Couldn't read ACK")
+
+	cs := pair.client.CreateStream()
+	cs.Write([]byte("abc"))
+
+	err = pair.client.InitiateKeyUpdate()
+	assertNotError(t, err, "Couldn't update keys")
+	err = pair.client.InitiateKeyUpdate()
+	assertError(t, err, "Allowed a second update before the peer followed")
+	cs.Write([]byte("def"))
+
+	// Deliver the new phase first, then the old one, after any
+	// cleartext.
+	pipe := pair.client.transport.(*testTransport).w
+	var clear, protected []*testPacket
+	for _, p := range pipe.out {
+		if p.b[0]&0x7f == packetTypeClientCleartext {
+			clear = append(clear, p)
+		} else {
+			protected = append([]*testPacket{p}, protected...)
+		}
+	}
+	pipe.out = append(clear, protected...)
+	err = inputAll(pair.server)
+	assertNotError(t, err, "Couldn't read packets across the update")
+	assertEquals(t, uint8(packetType1RTTProtectedPhase1), pair.server.writePhase)
+
+	ss := pair.server.GetStream(1)
+	assertByteEquals(t, []byte("abcdef"), ss.readAll())
+
+	// The server follows the update.
+	ss.Write([]byte("ghi"))
+	err = inputAll(pair.client)
+	assertNotError(t, err, "Couldn't read server data")
+	assertByteEquals(t, []byte("ghi"), cs.readAll())
+
+	err = pair.client.InitiateKeyUpdate()
+	assertNotError(t, err, "Couldn't do a second update")
+}
+
+func TestAckAcrossKeyUpdate(t *testing.T) {
+	pair := newCsPair(t)
+	pair.handshake(t)
+	inputAll(pair.server)
+	pair.server.ackThreshold = 1
+
+	cs := pair.client.CreateStream()
+	cs.Write([]byte("abc"))
+	err := pair.client.InitiateKeyUpdate()
+	assertNotError(t, err, "Couldn't update keys")
+	cs.Write([]byte("def"))
+	assertX(t, cs.outstandingQueuedBytes() > 0, "Nothing outstanding")
+
+	// A forged cleartext ACK for the protected packets is ignored.
+	ack := &ackFrame{
+		Type:                kFrameTypeAck,
+		LargestAcknowledged: pair.client.nextSendPacket - 1,
+		FirstAckBlockLength: 10,
+	}
+	err = pair.client.processAckFrame(ack, false)
+	assertNotError(t, err, "Couldn't process ACK")
+	assertEquals(t, 6, cs.outstandingQueuedBytes())
+
+	// The server's ACK covers packets from both key phases.
+	err = inputAll(pair.server)
+	assertNotError(t, err, "Couldn't read data")
+	err = inputAll(pair.client)
+	assertNotError(t, err, "Couldn't read ACK")
+	assertEquals(t, 0, cs.outstandingQueuedBytes())
+}
+
+func TestRttSampled(t *testing.T) {
+	pair := newCsPair(t)
+	pair.handshake(t)
+
+	assertX(t, pair.client.Stats().SmoothedRtt > 0, "Client has no RTT estimate")
+	assertX(t, pair.client.Stats().MinRtt <= pair.client.Stats().LatestRtt, "Min RTT above latest")
+}
+
+func TestHandshakeDuration(t *testing.T) {
+	pair := newCsPair(t)
+	assertEquals(t, time.Duration(0), pair.client.HandshakeDuration())
+
+	pair.handshake(t)
+	inputAll(pair.server)
+	assertX(t, pair.client.HandshakeDuration() > 0, "Client handshake took no time")
+	assertX(t, pair.server.HandshakeDuration() > 0, "Server handshake took no time")
+	assertX(t, pair.client.HandshakeDuration() < time.Minute, "Client handshake took too long")
+	assertX(t, !pair.client.HandshakeRestarted(), "Handshake was restarted")
+}
+
+// Protect |frames| in a short header packet from |c|, with a 4 octet
+// packet number.
+func shortHeaderPacket(t *testing.T, c *Connection, phase1 bool, frames []frame) []byte {
+	return shortHeaderPacketType(t, c, 0x03, phase1, frames)
+}
+
+func shortHeaderPacketType(t *testing.T, c *Connection, typ byte, phase1 bool, frames []frame) []byte {
+	hdr := packetHeader{packetFlagC | typ, c.serverConnId, c.nextSendPacket, 0}
+	if phase1 {
+		hdr.Type |= packetFlagK
+	}
+	c.nextSendPacket++
+	h, err := encode(&hdr)
+	assertNotError(t, err, "Couldn't encode header")
+
+	var payload []byte
+	for _, f := range frames {
+		_, err = f.length()
+		assertNotError(t, err, "Couldn't encode frame")
+		payload = append(payload, f.encoded...)
+	}
+	return append(h, c.writeProtected.aead.Seal(nil, c.packetNonce(hdr.PacketNumber), payload, h)...)
+}
+
+func TestAutomaticKeyUpdate(t *testing.T) {
+	pair := newCsPair(t)
+	pair.handshake(t)
+	inputAll(pair.server)
+	inputAll(pair.client)
+	pair.client.mtuMax = pair.client.mtu // No MTU probes.
+	pair.client.SetKeyUpdateLimit(3)
+
+	cs := pair.client.CreateStream()
+	for i := 0; i < 3; i++ {
+		_, err := cs.Write([]byte{byte(i)})
+		assertNotError(t, err, "Couldn't write")
+	}
+	assertEquals(t, uint8(packetType1RTTProtectedPhase1), pair.client.writePhase)
+	_, err := cs.Write([]byte{3})
+	assertNotError(t, err, "Couldn't write")
+
+	// The server follows and everything arrives.
+	err = inputAll(pair.server)
+	assertNotError(t, err, "Couldn't read packets across the update")
+	assertEquals(t, uint8(packetType1RTTProtectedPhase1), pair.server.readPhase)
+	assertByteEquals(t, []byte{0, 1, 2, 3}, pair.server.GetStream(1).readAll())
+
+	// The client hasn't seen the server's new keys yet, so it can't
+	// update again.
+	pair.client.SetKeyUpdateLimit(1)
+	_, err = cs.Write([]byte{4})
+	assertNotError(t, err, "Couldn't write")
+	assertEquals(t, uint8(packetType1RTTProtectedPhase1), pair.client.writePhase)
+}
+
+func TestShortHeaderKeyPhase(t *testing.T) {
+	pair := newCsPair(t)
+	pair.handshake(t)
+	inputAll(pair.server)
+	inputAll(pair.client)
+
+	f := newStreamFrame(1, 0, []byte("abc"))
+	err := pair.server.Input(shortHeaderPacket(t, pair.client, false, []frame{f}))
+	assertNotError(t, err, "Couldn't read short header")
+	assertByteEquals(t, []byte("abc"), pair.server.GetStream(1).readAll())
+
+	// The key phase bit has to match the keys.
+	f = newStreamFrame(1, 3, []byte("def"))
+	err = pair.server.Input(shortHeaderPacket(t, pair.client, true, []frame{f}))
+	assertError(t, err, "Accepted the wrong key phase")
+	assertEquals(t, uint8(packetType1RTTProtectedPhase0), pair.server.readPhase)
+
+	err = pair.client.InitiateKeyUpdate()
+	assertNotError(t, err, "Couldn't update keys")
+	err = pair.server.Input(shortHeaderPacket(t, pair.client, true, []frame{f}))
+	assertNotError(t, err, "Couldn't read short header after update")
+	assertEquals(t, uint8(packetType1RTTProtectedPhase1), pair.server.readPhase)
+	assertByteEquals(t, []byte("def"), pair.server.GetStream(1).readAll())
+}
+
+func TestShortHeaderPacketNumbers(t *testing.T) {
+	pair := newCsPair(t)
+	pair.handshake(t)
+	inputAll(pair.server)
+	inputAll(pair.client)
+
+	// Jump to just below a 1 octet boundary with a full packet
+	// number, then cross it so that the low bits wrap.
+	pair.client.nextSendPacket |= 0xfe
+	off := uint64(0)
+	for _, typ := range []byte{0x03, 0x01, 0x01, 0x02} {
+		f := newStreamFrame(1, off, []byte{typ})
+		err := pair.server.Input(shortHeaderPacketType(t, pair.client, typ, false, []frame{f}))
+		assertNotError(t, err, "Couldn't read short header")
+		off++
+	}
+	assertByteEquals(t, []byte{3, 1, 1, 2}, pair.server.GetStream(1).readAll())
+	assertEquals(t, pair.client.nextSendPacket-1, pair.server.largestRecvd)
+}
+
+func TestExpandPacketNumber(t *testing.T) {
+	c := &Connection{largestRecvd: 0xabe8bc}
+	assertEquals(t, uint64(0xab9b2b), c.expandPacketNumber(0x9b2b, 2))
+	assertEquals(t, uint64(0xabe8bd), c.expandPacketNumber(0xbd, 1))
+	assertEquals(t, uint64(0xabe901), c.expandPacketNumber(0x01, 1))
+	assertEquals(t, uint64(0xabe87f), c.expandPacketNumber(0x7f, 1))
+}
+
+func TestMTUProbe(t *testing.T) {
+	pair := newCsPair(t)
+	pair.handshake(t)
+	inputAll(pair.server)
+	inputAll(pair.client)
+	assertEquals(t, kInitialMTU, pair.client.Stats().MTU)
+
+	// A probe that is acknowledged raises the MTU.
+	pipe := pair.client.transport.(*testTransport).w
+	pipe.out = nil
+	_, err := pair.client.CheckTimer()
+	assertNotError(t, err, "Couldn't send probe")
+	assertEquals(t, 1, len(pipe.out))
+	assertEquals(t, kInitialMTU+kMTUProbeStep, len(pipe.out[0].b))
+	err = inputAll(pair.server)
+	assertNotError(t, err, "Couldn't read probe")
+	err = inputAll(pair.client)
+	assertNotError(t, err, "Couldn't read ACK")
+	assertEquals(t, kInitialMTU+kMTUProbeStep, pair.client.Stats().MTU)
+
+	// A lost probe ends the search.
+	pair.client.mtuProbeSent = time.Time{}
+	_, err = pair.client.CheckTimer()
+	assertNotError(t, err, "Couldn't send probe")
+	assertEquals(t, kMaximumMTU, pair.client.mtuProbeSize)
+	pipe.out = nil
+	pair.client.mtuProbeSent = time.Now().Add(-time.Minute)
+	_, err = pair.client.CheckTimer()
+	assertNotError(t, err, "Couldn't time out probe")
+	assertEquals(t, 0, len(pipe.out))
+	assertEquals(t, kInitialMTU+kMTUProbeStep, pair.client.Stats().MTU)
+	assertX(t, pair.client.NextTimerExpiry().IsZero(), "Still probing")
+}
+
+func TestMTUProbeSendError(t *testing.T) {
+	pair := newCsPair(t)
+	pair.handshake(t)
+	inputAll(pair.server)
+	inputAll(pair.client)
+
+	// A probe that the transport can't send waits for the interval
+	// before it is tried again.
+	pair.client.transport = &testErrorTransport{*pair.client.transport.(*testTransport), syscall.ENOBUFS}
+	_, err := pair.client.CheckTimer()
+	assertNotError(t, err, "ENOBUFS should not be an error")
+	assertX(t, pair.client.NextTimerExpiry().After(time.Now()), "Probe is already due")
+	pn := pair.client.nextSendPacket
+	_, err = pair.client.CheckTimer()
+	assertNotError(t, err, "ENOBUFS should not be an error")
+	assertEquals(t, pn, pair.client.nextSendPacket)
+}
+
+func TestLossDetection(t *testing.T) {
+	pair := newCsPair(t)
+	pair.handshake(t)
+	err := inputAll(pair.server)
+	assertNotError(t, err, "Couldn't finish handshake")
+	err = inputAll(pair.client)
+	assertNotError(t, err, "Couldn't read server ACK")
+	pair.client.mtuMax = pair.client.mtu // No MTU probes.
+
+	cs := pair.client.CreateStream()
+	pipe := pair.client.transport.(*testTransport).w
+	pipe.out = nil
+	for i := byte(0); i < 4; i++ {
+		_, err = cs.Write([]byte{i})
+		assertNotError(t, err, "Couldn't write")
+	}
+	assertEquals(t, 4, len(pipe.out))
+
+	// Nothing is resent until there is a reason to.
+	pipe.out = pipe.out[1:]
+	_, err = pair.client.CheckTimer()
+	assertNotError(t, err, "Couldn't check timer")
+	assertEquals(t, 3, len(pipe.out))
+
+	// An ACK for the later packets makes the first one lost.
+	err = inputAll(pair.server)
+	assertNotError(t, err, "Couldn't read data")
+	_, err = pair.server.sendQueued(true)
+	assertNotError(t, err, "Couldn't send ACK")
+	err = inputAll(pair.client)
+	assertNotError(t, err, "Couldn't read ACK")
+	_, err = pair.client.CheckTimer()
+	assertNotError(t, err, "Couldn't resend")
+	err = inputAll(pair.server)
+	assertNotError(t, err, "Couldn't read resent data")
+
+	b := make([]byte, 10)
+	n, err := pair.server.GetStream(1).Read(b)
+	assertNotError(t, err, "Couldn't read stream")
+	assertByteEquals(t, []byte{0, 1, 2, 3}, b[:n])
+}
+
+func TestSpuriousRetransmit(t *testing.T) {
+	pair := newCsPair(t)
+	pair.handshake(t)
+	err := inputAll(pair.server)
+	assertNotError(t, err, "Couldn't finish handshake")
+	err = inputAll(pair.client)
+	assertNotError(t, err, "Couldn't read server ACK")
+	pair.client.mtuMax = pair.client.mtu // No MTU probes.
+
+	cs := pair.client.CreateStream()
+	pipe := pair.client.transport.(*testTransport).w
+	pipe.out = nil
+	for i := byte(0); i < 4; i++ {
+		_, err = cs.Write([]byte{i})
+		assertNotError(t, err, "Couldn't write")
+	}
+
+	// Hold the first packet back until the others are acknowledged.
+	delayed := pipe.out[0]
+	pipe.out = pipe.out[1:]
+	err = inputAll(pair.server)
+	assertNotError(t, err, "Couldn't read data")
+	_, err = pair.server.sendQueued(true)
+	assertNotError(t, err, "Couldn't send ACK")
+	err = inputAll(pair.client)
+	assertNotError(t, err, "Couldn't read ACK")
+	_, err = pair.client.CheckTimer()
+	assertNotError(t, err, "Couldn't resend")
+	assertEquals(t, 0, pair.client.Stats().SpuriousRetransmits)
+
+	// Now the original turns up and is acknowledged.
+	pipe.out = []*testPacket{delayed}
+	err = inputAll(pair.server)
+	assertNotError(t, err, "Couldn't read delayed packet")
+	_, err = pair.server.sendQueued(true)
+	assertNotError(t, err, "Couldn't send ACK")
+	err = inputAll(pair.client)
+	assertNotError(t, err, "Couldn't read ACK")
+	assertEquals(t, 1, pair.client.Stats().SpuriousRetransmits)
+}
+
+func TestLossDetectionAckBlocks(t *testing.T) {
+	pair := newCsPair(t)
+	pair.handshake(t)
+	err := inputAll(pair.server)
+	assertNotError(t, err, "Couldn't finish handshake")
+	err = inputAll(pair.client)
+	assertNotError(t, err, "Couldn't read server ACK")
+	pair.client.mtuMax = pair.client.mtu // No MTU probes.
+
+	cs := pair.client.CreateStream()
+	pipe := pair.client.transport.(*testTransport).w
+	pipe.out = nil
+	for i := byte(0); i < 5; i++ {
+		_, err = cs.Write([]byte{i})
+		assertNotError(t, err, "Couldn't write")
+	}
+
+	// Lose the second packet. The ACK has two blocks, and only the
+	// data in the gap is lost.
+	pipe.out = append(pipe.out[:1], pipe.out[2:]...)
+	err = inputAll(pair.server)
+	assertNotError(t, err, "Couldn't read data")
+	_, err = pair.server.sendQueued(true)
+	assertNotError(t, err, "Couldn't send ACK")
+	err = inputAll(pair.client)
+	assertNotError(t, err, "Couldn't read ACK")
+	assertEquals(t, 1, pair.client.outstandingQueuedBytes())
+
+	_, err = pair.client.CheckTimer()
+	assertNotError(t, err, "Couldn't resend")
+	assertEquals(t, 1, len(pipe.out))
+	err = inputAll(pair.server)
+	assertNotError(t, err, "Couldn't read resent data")
+	assertByteEquals(t, []byte{0, 1, 2, 3, 4}, pair.server.GetStream(1).readAll())
+}
+
+func TestAckOnlyPacketsNotTracked(t *testing.T) {
+	pair := newCsPair(t)
+	pair.handshake(t)
+	inputAll(pair.server)
+	inputAll(pair.client)
+	pair.client.mtuMax = pair.client.mtu // No MTU probes.
+
+	// A client that only receives only sends ACKs.
+	tracked := len(pair.client.sentPackets)
+	ss := pair.server.CreateStream()
+	for i := 0; i < 10; i++ {
+		_, err := ss.Write([]byte{byte(i)})
+		assertNotError(t, err, "Couldn't write")
+		err = inputAll(pair.client)
+		assertNotError(t, err, "Couldn't read data")
+		_, err = pair.client.sendQueued(true)
+		assertNotError(t, err, "Couldn't send ACK")
+	}
+	assertEquals(t, tracked, len(pair.client.sentPackets))
+}
+
+func TestProbeTimeout(t *testing.T) {
+	pair := newCsPair(t)
+	pair.handshake(t)
+	err := inputAll(pair.server)
+	assertNotError(t, err, "Couldn't finish handshake")
+	err = inputAll(pair.client)
+	assertNotError(t, err, "Couldn't read server ACK")
+	pair.client.mtuMax = pair.client.mtu // No MTU probes.
 
+	cs := pair.client.CreateStream()
+	pipe := pair.client.transport.(*testTransport).w
+	_, err = cs.Write([]byte("lost"))
+	assertNotError(t, err, "Couldn't write")
+	pipe.out = nil
+
+	// The PTO only fires once it has expired, and backs off.
+	_, err = pair.client.CheckTimer()
+	assertNotError(t, err, "Couldn't check timer")
+	assertEquals(t, 0, len(pipe.out))
+	interval := pair.client.rtt.retransmitInterval()
+	loss := pair.client.loss.(*defaultLossDetector)
+	pto := pair.client.NextTimerExpiry()
+	assertX(t, pto.Equal(loss.lastDataSend.Add(interval)), "Wrong PTO")
+
+	// Sending ACKs doesn't push the PTO back.
+	ss := pair.server.CreateStream()
+	_, err = ss.Write([]byte("x"))
+	assertNotError(t, err, "Couldn't write on server")
+	err = inputAll(pair.client)
+	assertNotError(t, err, "Couldn't read server data")
+	_, err = pair.client.sendQueued(true)
+	assertNotError(t, err, "Couldn't send ACK")
+	assertEquals(t, 1, len(pipe.out))
+	assertX(t, pair.client.NextTimerExpiry().Equal(pto), "ACK moved the PTO")
+	pipe.out = nil
+
+	loss.lastDataSend = loss.lastDataSend.Add(-interval)
+	_, err = pair.client.CheckTimer()
+	assertNotError(t, err, "Couldn't send probe")
+	assertEquals(t, 1, len(pipe.out))
+	assertEquals(t, 1, loss.ptoCount)
+	assertX(t, pair.client.NextTimerExpiry().Equal(loss.lastDataSend.Add(2*interval)), "PTO didn't back off")
+
+	// An ACK for the probe resets the backoff.
+	err = inputAll(pair.server)
+	assertNotError(t, err, "Couldn't read probe")
+	_, err = pair.server.sendQueued(true)
+	assertNotError(t, err, "Couldn't send ACK")
+	err = inputAll(pair.client)
+	assertNotError(t, err, "Couldn't read ACK")
+	assertEquals(t, 0, loss.ptoCount)
+	assertEquals(t, 0, pair.client.outstandingQueuedBytes())
+}
+
+func TestStreamPriority(t *testing.T) {
+	pair := newCsPair(t)
+	pair.handshake(t)
+	err := inputAll(pair.server)
+	assertNotError(t, err, "Couldn't finish handshake")
+
+	pair.client.CreateStream()
+	pair.client.CreateStream()
+	low := pair.client.GetStream(1)
+	high := pair.client.GetStream(3)
+	high.SetPriority(1)
+
+	// Queue enough that each stream needs its own packet.
+	low.send(make([]byte, 1000))
+	high.send(make([]byte, 1000))
+	pipe := pair.client.transport.(*testTransport).w
+	pipe.out = nil
+	_, err = pair.client.sendQueued(false)
+	assertNotError(t, err, "Couldn't send")
+
+	// Deliver only the first protected packet.
+	for len(pipe.out) > 0 && pipe.out[0].b[0]&0x7f == packetTypeClientCleartext {
+		pipe.out = pipe.out[1:]
+	}
+	pipe.out = pipe.out[:1]
+	err = inputAll(pair.server)
+	assertNotError(t, err, "Couldn't read first packet")
+	assertEquals(t, 1000, len(pair.server.GetStream(3).readAll()))
+	assertEquals(t, 0, len(pair.server.GetStream(1).readAll()))
+
+	// Equal priorities take turns.
+	high.SetPriority(0)
+	first := pair.client.prioritizedStreams()[0].id
+	assertX(t, first != pair.client.prioritizedStreams()[0].id, "Streams didn't rotate")
+}
+
+func TestKill(t *testing.T) {
+	pair := newCsPair(t)
+	pair.handshake(t)
+	cs := pair.client.CreateStream()
+	cs.Write([]byte("abcdef"))
+
+	pipe := pair.client.transport.(*testTransport).w
+	pipe.out = nil
+	pair.client.Kill()
+	assertEquals(t, StateClosed, pair.client.GetState())
+	assertEquals(t, 0, len(pipe.out))
+	assertX(t, pair.client.GetStream(1) == nil, "Streams not released")
+
+	n, err := pair.client.CheckTimer()
+	assertNotError(t, err, "CheckTimer on killed connection")
+	assertEquals(t, 0, n)
+	assertEquals(t, 0, len(pipe.out))
+
+	// This works even before the handshake is done.
+	client := NewConnection(pair.client.transport, RoleClient, testTlsConfig, nil)
+	client.Kill()
+	assertEquals(t, StateClosed, client.GetState())
+	assertEquals(t, 0, len(pipe.out))
+}
+
+// A client transport for Connect() which has the server, if any,
+// process whatever the client sent before each read.
+type testConnectTransport struct {
+	*testTransport
+	server *Connection
+}
+
+func (t *testConnectTransport) Read(deadline time.Time) ([]byte, error) {
+	if t.server != nil {
+		err := inputAll(t.server)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return t.Recv()
+}
+
+func TestConnect(t *testing.T) {
+	cTrans, sTrans := newTestTransportPair(true)
+	server := NewConnection(sTrans, RoleServer, testTlsConfig, nil)
+	client := NewConnection(&testConnectTransport{cTrans, server}, RoleClient, testTlsConfig, nil)
+
+	err := client.Connect(context.Background())
+	assertNotError(t, err, "Couldn't connect")
+	assertEquals(t, StateEstablished, client.GetState())
+
+	err = server.Connect(context.Background())
+	assertError(t, err, "Server connection connected")
+}
+
+func TestConnectCancelled(t *testing.T) {
+	cTrans, _ := newTestTransportPair(true)
+	client := NewConnection(&testConnectTransport{cTrans, nil}, RoleClient, testTlsConfig, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := client.Connect(ctx)
+	assertEquals(t, context.Canceled, err)
+
+	// Without a ReadTransport.
+	client = NewConnection(cTrans, RoleClient, testTlsConfig, nil)
+	err = client.Connect(context.Background())
+	assertError(t, err, "Connected without a ReadTransport")
+}
+
+type testConnectionHandler struct {
+	resets   map[uint32]ErrorCode
+	finished []uint32
+}
+
+func (h *testConnectionHandler) StateChanged(s State) {
+}
+
+func (h *testConnectionHandler) NewStream(s *Stream) {
+}
+
+func (h *testConnectionHandler) StreamReadable(s *Stream) {
+}
+
+func (h *testConnectionHandler) StreamFinished(s *Stream) {
+	h.finished = append(h.finished, s.Id())
+}
+
+func (h *testConnectionHandler) StreamReset(s *Stream, code ErrorCode) {
+	h.resets[s.Id()] = code
+}
+
+func TestStreamReset(t *testing.T) {
+	pair := newCsPair(t)
+	h := &testConnectionHandler{make(map[uint32]ErrorCode), nil}
+	pair.server.SetHandler(h)
+	pair.handshake(t)
+
+	cs := pair.client.CreateStream()
+	cs.Write([]byte("abc"))
+	err := inputAll(pair.server)
+	assertNotError(t, err, "Couldn't read data")
+
+	err = cs.Reset(7)
+	assertNotError(t, err, "Couldn't reset stream")
+	err = inputAll(pair.server)
+	assertNotError(t, err, "Couldn't read RST_STREAM")
+
+	assertEquals(t, ErrorCode(7), h.resets[cs.Id()])
+	_, err = pair.server.GetStream(cs.Id()).Read(make([]byte, 10))
+	assertEquals(t, ErrorStreamIsReset, err)
+
+	// The handshake stream can't be reset.
+	err = pair.client.GetStream(0).Reset(7)
+	assertEquals(t, ErrorStreamIsHandshake, err)
+}
+
+// Decrypt a protected packet that |c| is about to receive and return
+// the first frame in it.
+func firstProtectedFrame(t *testing.T, c *Connection, p []byte) *frame {
+	var hdr packetHeader
+	hdrlen, err := decode(&hdr, p)
+	assertNotError(t, err, "Couldn't decode header")
+	payload, err := c.readProtected.aead.Open(nil, c.packetNonce(hdr.PacketNumber), p[hdrlen:], p[:hdrlen])
+	assertNotError(t, err, "Couldn't decrypt packet")
+	_, f, err := decodeFrame(payload)
+	assertNotError(t, err, "Couldn't decode frame")
+	return f
+}
+
+func TestApplicationErrors(t *testing.T) {
+	pair := newCsPair(t)
+	pair.handshake(t)
+	inputAll(pair.server)
+	pipe := pair.client.transport.(*testTransport).w
+
+	cs := pair.client.CreateStream()
+	inputAll(pair.server)
+	err := cs.Reset(kApplicationErrorMax + 1)
+	assertError(t, err, "Reset with a transport code")
+	err = cs.Reset(9)
+	assertNotError(t, err, "Couldn't reset stream")
+	f := firstProtectedFrame(t, pair.server, pipe.out[len(pipe.out)-1].b)
+	rst, ok := f.f.(*rstStreamFrame)
+	assertX(t, ok, "Expected RST_STREAM")
+	assertEquals(t, uint32(9), rst.ErrorCode)
+
+	err = pair.client.CloseWithError(ApplicationError(kQuicErrorNoError), "Bogus")
+	assertError(t, err, "Close with a transport code")
+	assertEquals(t, StateEstablished, pair.client.GetState())
+	err = pair.client.CloseWithError(5, "Done")
+	assertNotError(t, err, "Couldn't close")
+	assertEquals(t, StateClosed, pair.client.GetState())
+	f = firstProtectedFrame(t, pair.server, pipe.out[len(pipe.out)-1].b)
+	cc, ok := f.f.(*connectionCloseFrame)
+	assertX(t, ok, "Expected CONNECTION_CLOSE")
+	assertEquals(t, uint32(5), cc.ErrorCode)
+
+	// The transport's own codes are unaffected.
+	spipe := pair.server.transport.(*testTransport).w
+	pair.server.Close()
+	f = firstProtectedFrame(t, pair.client, spipe.out[len(spipe.out)-1].b)
+	cc, ok = f.f.(*connectionCloseFrame)
+	assertX(t, ok, "Expected CONNECTION_CLOSE")
+	assertEquals(t, uint32(kQuicErrorNoError), cc.ErrorCode)
+}
+
+func TestCloseFlushesAcks(t *testing.T) {
+	pair := newCsPair(t)
+	pair.handshake(t)
+	inputAll(pair.server)
+	inputAll(pair.client)
+
+	// One packet isn't enough to make the server ACK straight away.
+	cs := pair.client.CreateStream()
+	_, err := cs.Write([]byte("abc"))
+	assertNotError(t, err, "Couldn't write")
+	spipe := pair.server.transport.(*testTransport).w
+	spipe.out = nil
+	err = inputAll(pair.server)
+	assertNotError(t, err, "Couldn't read data")
+	assertEquals(t, 0, len(spipe.out))
+
+	pair.server.Close()
+	assertEquals(t, 2, len(spipe.out))
+	f := firstProtectedFrame(t, pair.client, spipe.out[0].b)
+	_, ok := f.f.(*ackFrame)
+	assertX(t, ok, "Expected ACK")
+	f = firstProtectedFrame(t, pair.client, spipe.out[1].b)
+	_, ok = f.f.(*connectionCloseFrame)
+	assertX(t, ok, "Expected CONNECTION_CLOSE")
+}
+
+func TestStreamFinished(t *testing.T) {
+	pair := newCsPair(t)
+	h := &testConnectionHandler{make(map[uint32]ErrorCode), nil}
+	pair.server.SetHandler(h)
+	pair.handshake(t)
+	cs := pair.client.CreateStream()
+
+	// Send the FIN first, then the data before it.
+	fin := newStreamFrame(cs.Id(), 3, []byte("def"))
+	fin.f.(*streamFrame).Typ |= kFrameTypeFlagF
+	err := pair.client.sendPacket(packetType1RTTProtectedPhase0, []frame{fin})
+	assertNotError(t, err, "Couldn't send FIN")
+	err = inputAll(pair.server)
+	assertNotError(t, err, "Couldn't read FIN")
+	assertEquals(t, 0, len(h.finished))
+	assertX(t, pair.server.GetStream(cs.Id()).finReceived, "FIN not seen")
+
+	err = pair.client.sendPacket(packetType1RTTProtectedPhase0, []frame{newStreamFrame(cs.Id(), 0, []byte("abc"))})
+	assertNotError(t, err, "Couldn't send data")
+	err = inputAll(pair.server)
+	assertNotError(t, err, "Couldn't read data")
+	assertEquals(t, "[1]", fmt.Sprintf("%v", h.finished))
+
+	ss := pair.server.GetStream(cs.Id())
+	b := make([]byte, 10)
+	n, err := ss.Read(b)
+	assertNotError(t, err, "Couldn't read stream")
+	assertByteEquals(t, []byte("abcdef"), b[:n])
+	_, err = ss.Read(b)
+	assertEquals(t, io.EOF, err)
+}
+
+func TestSendMessage(t *testing.T) {
+	pair := newCsPair(t)
+	pair.handshake(t)
+	inputAll(pair.server)
+
+	cs, err := pair.client.SendMessage([]byte("ping"))
+	assertNotError(t, err, "Couldn't send message")
+	// Opening more streams leaves |cs| usable.
+	for i := 0; i < 40; i++ {
+		pair.client.CreateStream()
+	}
+	err = inputAll(pair.server)
+	assertNotError(t, err, "Couldn't read message")
+
+	ss := pair.server.GetStream(cs.Id())
+	b := make([]byte, 10)
+	n, err := ss.Read(b)
+	assertNotError(t, err, "Couldn't read request")
+	assertByteEquals(t, []byte("ping"), b[:n])
+	_, err = ss.Read(b)
+	assertEquals(t, io.EOF, err)
+
+	// The server's side is still open.
+	_, err = ss.Write([]byte("pong"))
+	assertNotError(t, err, "Couldn't write response")
+	err = ss.Close()
+	assertNotError(t, err, "Couldn't close response")
+	_, err = ss.Write([]byte("more"))
+	assertEquals(t, ErrorStreamIsClosed, err)
+
+	err = inputAll(pair.client)
+	assertNotError(t, err, "Couldn't read response")
+	n, err = cs.Read(b)
+	assertNotError(t, err, "Couldn't read response")
+	assertByteEquals(t, []byte("pong"), b[:n])
+	_, err = cs.Read(b)
+	assertEquals(t, io.EOF, err)
+
+	// The handshake stream can't be closed.
+	err = pair.client.GetStream(0).Close()
+	assertEquals(t, ErrorStreamIsHandshake, err)
+}
+
+func TestStreamIdleTimeout(t *testing.T) {
+	pair := newCsPair(t)
+	h := &testConnectionHandler{make(map[uint32]ErrorCode), nil}
+	pair.server.SetHandler(h)
+	pair.handshake(t)
+	err := inputAll(pair.server)
+	assertNotError(t, err, "Couldn't finish handshake")
+
+	pair.client.SetStreamIdleTimeout(time.Hour)
+	pair.client.CreateStream().Write([]byte("abc"))
+	pair.client.CreateStream().Write([]byte("def"))
+	finished := pair.client.CreateStream()
+	finished.Write([]byte("ghi"))
+	finished.Close()
+	err = inputAll(pair.server)
+	assertNotError(t, err, "Couldn't read data")
+	assertX(t, !pair.client.NextTimerExpiry().IsZero(), "No timer for idle streams")
+
+	// Make the first stream look idle. A stream that has finished
+	// isn't reset however long it has been idle.
+	idle := pair.client.GetStream(1)
+	idle.lastActive = idle.lastActive.Add(-2 * time.Hour)
+	finished.lastActive = finished.lastActive.Add(-2 * time.Hour)
+	_, err = pair.client.CheckTimer()
+	assertNotError(t, err, "Couldn't check timer")
+	err = inputAll(pair.server)
+	assertNotError(t, err, "Couldn't read RST_STREAM")
+
+	assertEquals(t, 1, len(h.resets))
+	assertEquals(t, kQuicErrorCancelled, h.resets[1])
+	_, err = idle.Read(make([]byte, 10))
+	assertEquals(t, ErrorStreamResetLocally, err)
+	_, err = idle.Write([]byte("jkl"))
+	assertEquals(t, ErrorStreamResetLocally, err)
+}
+
+func TestALPN(t *testing.T) {
+	for _, alpn := range [][]string{{"foo", "bar"}, {"foo"}, nil} {
+		cTrans, sTrans := newTestTransportPair(true)
+		cConfig := testTlsConfig
+		cConfig.ALPN = []string{"bar"}
+		sConfig := testTlsConfig
+		sConfig.ALPN = alpn
+		pair := &csPair{
+			NewConnection(cTrans, RoleClient, cConfig, nil),
+			NewConnection(sTrans, RoleServer, sConfig, nil),
+		}
+
+		_, err := pair.client.CheckTimer()
+		assertNotError(t, err, "Couldn't send client initial")
+		err = inputAll(pair.server)
+		assertNotError(t, err, "Couldn't read client initial")
+		err = inputAll(pair.client)
+		if len(alpn) < 2 {
+			// No overlap, or the server only speaks the default.
+			var qerr *QuicError
+			assertX(t, errors.As(err, &qerr), "ALPN mismatch wasn't a QuicError")
+			assertEquals(t, kQuicErrorTlsFatalAlertGenerated, qerr.Code)
+			assertX(t, errors.Is(err, ErrorFatal), "ALPN mismatch wasn't fatal")
+			assertEquals(t, StateError, pair.client.GetState())
+
+			// The server is told.
+			err = inputAll(pair.server)
+			assertX(t, errors.As(err, &qerr), "Received alert wasn't a QuicError")
+			assertEquals(t, kQuicErrorTlsFatalAlertReceived, qerr.Code)
+			assertX(t, errors.Is(err, ErrorFatal), "Received alert wasn't fatal")
+			assertEquals(t, StateError, pair.server.GetState())
+		} else {
+			assertNotError(t, err, "Handshake failed")
+			assertEquals(t, StateEstablished, pair.client.GetState())
+		}
+	}
 }
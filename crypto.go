@@ -6,24 +6,34 @@ import (
 )
 
 type cryptoState struct {
-	secret []byte
-	aead   cipher.AEAD
+	cs          *mint.CipherSuiteParams
+	updateLabel string
+	secret      []byte
+	aead        cipher.AEAD
 }
 
 const clientPpSecretLabel = "EXPORTER-QUIC client 1-RTT Secret"
 const serverPpSecretLabel = "EXPORTER-QUIC server 1-RTT Secret"
 
-func newCryptoState(t *tlsConn, label string) (*cryptoState, error) {
-	var st cryptoState
-	var err error
+// Labels for deriving the next generation of secrets on key update.
+const clientPpUpdateLabel = "QUIC client 1-RTT Secret"
+const serverPpUpdateLabel = "QUIC server 1-RTT Secret"
 
-	st.secret, err = t.tls.ComputeExporter(label, []byte{}, t.cs.Hash.Size())
+func newCryptoState(t *tlsConn, label string, updateLabel string) (*cryptoState, error) {
+	secret, err := t.tls.ComputeExporter(label, []byte{}, t.cs.Hash.Size())
 	if err != nil {
 		return nil, err
 	}
 
-	k := mint.HkdfExpandLabel(t.cs.Hash, st.secret, "key", []byte{}, t.cs.KeyLen)
-	iv := mint.HkdfExpandLabel(t.cs.Hash, st.secret, "iv", []byte{}, t.cs.IvLen)
+	return newCryptoStateFromSecret(t.cs, updateLabel, secret)
+}
+
+func newCryptoStateFromSecret(cs *mint.CipherSuiteParams, updateLabel string, secret []byte) (*cryptoState, error) {
+	var err error
+	st := cryptoState{cs: cs, updateLabel: updateLabel, secret: secret}
+
+	k := mint.HkdfExpandLabel(cs.Hash, st.secret, "key", []byte{}, cs.KeyLen)
+	iv := mint.HkdfExpandLabel(cs.Hash, st.secret, "iv", []byte{}, cs.IvLen)
 
 	st.aead, err = newWrappedAESGCM(k, iv)
 	if err != nil {
@@ -32,3 +42,9 @@ func newCryptoState(t *tlsConn, label string) (*cryptoState, error) {
 
 	return &st, nil
 }
+
+// Derive the keys for the next key phase.
+func (st *cryptoState) next() (*cryptoState, error) {
+	secret := mint.HkdfExpandLabel(st.cs.Hash, st.secret, st.updateLabel, []byte{}, st.cs.Hash.Size())
+	return newCryptoStateFromSecret(st.cs, st.updateLabel, secret)
+}
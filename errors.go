@@ -6,12 +6,102 @@ import (
 
 // Return codes.
 var ErrorWouldBlock = fmt.Errorf("Would have blocked")
-var ErrorDestroyConnection = fmt.Errorf("Terminate connection")
-var ErrorReceivedVersionNegotiation = fmt.Errorf("Received a version negotiation packet advertising a different version than ours")
+var ErrorDestroyConnection = fatal(fmt.Errorf("Terminate connection"))
+var ErrorReceivedVersionNegotiation = fatal(fmt.Errorf("Received a version negotiation packet advertising a different version than ours"))
+var ErrorConnIsClosed = fatal(fmt.Errorf("Connection is closed"))
+var ErrorHandshakeStalled = fatal(fmt.Errorf("Handshake made no progress, even at the minimum MTU"))
+var ErrorStreamIsClosed = fmt.Errorf("Stream is closed")
+var ErrorStreamIsReset = fmt.Errorf("Stream was reset by the peer")
+var ErrorStreamResetLocally = fmt.Errorf("Stream was reset by us")
+var ErrorStreamIsHandshake = fmt.Errorf("Stream 0 carries the handshake")
 
-// Protocol errors
+// Returned when a stream's deadline has passed. Like the errors from
+// net.Conn deadlines, it has a Timeout() method which returns true.
+var ErrorDeadlineExceeded error = &timeoutError{}
+
+type timeoutError struct{}
+
+func (e *timeoutError) Error() string {
+	return "Deadline exceeded"
+}
+
+func (e *timeoutError) Timeout() bool {
+	return true
+}
+
+func (e *timeoutError) Temporary() bool {
+	return true
+}
+
+// Errors after which the connection can no longer be used match
+// ErrorFatal when tested with errors.Is. Other errors mean that
+// a single packet was discarded and the connection carries on.
+var ErrorFatal = fmt.Errorf("Fatal error")
+
+type fatalError struct {
+	error
+}
+
+func (e fatalError) Unwrap() error {
+	return e.error
+}
+
+func (e fatalError) Is(target error) bool {
+	return target == ErrorFatal
+}
+
+func fatal(err error) error {
+	return fatalError{err}
+}
+
+// Protocol errors. These are the codes that the transport itself
+// uses, which all have the top bit set.
 type ErrorCode uint32
 
+// Error codes chosen by the application for CloseWithError() and
+// Stream.Reset(). They share the 32-bit code space on the wire with
+// ErrorCode, but are restricted to the range reserved for
+// applications, so the two can't collide.
+type ApplicationError uint32
+
+const kApplicationErrorMax = ApplicationError(0x3fffffff)
+
+func (e ApplicationError) errorCode() (ErrorCode, error) {
+	if e > kApplicationErrorMax {
+		return 0, fmt.Errorf("Application error code 0x%x out of range", uint32(e))
+	}
+	return ErrorCode(e), nil
+}
+
+// QuicError is returned when a connection is closed because of a
+// protocol error. Use errors.As to retrieve the error code sent in
+// the CONNECTION_CLOSE; the underlying error is available via
+// errors.Unwrap.
+type QuicError struct {
+	Code ErrorCode
+	Err  error
+}
+
+func (e *QuicError) Error() string {
+	return fmt.Sprintf("QUIC error 0x%x: %v", uint32(e.Code), e.Err)
+}
+
+func (e *QuicError) Unwrap() error {
+	return e.Err
+}
+
+func (e *QuicError) Is(target error) bool {
+	return target == ErrorFatal
+}
+
 const (
-	kQuicErrorNoError = ErrorCode(0x80000000)
+	kQuicErrorNoError           = ErrorCode(0x80000000)
+	kQuicErrorCancelled         = ErrorCode(0x80000002)
+	kQuicErrorFlowControlError  = ErrorCode(0x80000003)
+	kQuicErrorStreamIdError     = ErrorCode(0x80000004)
+	kQuicErrorProtocolViolation = ErrorCode(0x8000000a)
+
+	kQuicErrorTlsHandshakeFailed     = ErrorCode(0x80000201)
+	kQuicErrorTlsFatalAlertGenerated = ErrorCode(0x80000202)
+	kQuicErrorTlsFatalAlertReceived  = ErrorCode(0x80000203)
 )
@@ -0,0 +1,22 @@
+package minq
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestQuicErrorUnwrap(t *testing.T) {
+	inner := fmt.Errorf("Bad stream")
+	err := fmt.Errorf("Processing packet: %w", &QuicError{kQuicErrorStreamIdError, inner})
+
+	var qerr *QuicError
+	assertX(t, errors.As(err, &qerr), "Expected a QuicError")
+	assertEquals(t, kQuicErrorStreamIdError, qerr.Code)
+	assertX(t, errors.Is(err, inner), "Should unwrap to the inner error")
+	assertX(t, !errors.Is(err, ErrorWouldBlock), "Shouldn't match a different error")
+
+	wb := fmt.Errorf("Reading: %w", ErrorWouldBlock)
+	assertX(t, errors.Is(wb, ErrorWouldBlock), "Should match ErrorWouldBlock")
+	assertX(t, !errors.As(wb, &qerr), "ErrorWouldBlock isn't a QuicError")
+}
@@ -24,7 +24,7 @@ const (
 )
 
 const (
-	kFrameTypeFlagF = frameType(0x40)
+	kFrameTypeFlagF = frameType(0x20)
 	kFrameTypeFlagD = frameType(0x01)
 )
 
@@ -129,6 +129,14 @@ func (f rstStreamFrame) getType() frameType {
 	return kFrameTypeRstStream
 }
 
+func newRstStreamFrame(streamId uint32, errcode ErrorCode, finalOffset uint64) frame {
+	return frame{streamId, &rstStreamFrame{
+		kFrameTypeRstStream,
+		streamId,
+		uint32(errcode),
+		finalOffset}, nil}
+}
+
 // CONNECTION_CLOSE
 type connectionCloseFrame struct {
 	Type               frameType
@@ -213,6 +221,10 @@ func (f pingFrame) getType() frameType {
 	return kFrameTypePing
 }
 
+func newPingFrame() frame {
+	return frame{0, &pingFrame{kFrameTypePing}, nil}
+}
+
 // BLOCKED
 type blockedFrame struct {
 	Type frameType
@@ -305,6 +317,42 @@ func (f ackFrame) TimestampSection__length() uintptr {
 	return uintptr(f.NumTS * 5)
 }
 
+// Get the ranges of packets that an ACK frame acknowledges, largest
+// first. Each block after the first starts |Gap| below the lowest
+// packet of the one before.
+func (f *ackFrame) ranges() ([]ackRange, error) {
+	rs := []ackRange{{f.LargestAcknowledged, f.FirstAckBlockLength + 1}}
+	if f.FirstAckBlockLength > f.LargestAcknowledged {
+		return nil, fmt.Errorf("ACK block goes below zero")
+	}
+	last := f.LargestAcknowledged - f.FirstAckBlockLength
+
+	section := f.AckBlockSection
+	for i := uint8(0); i < f.NumBlocks; i++ {
+		b := ackBlock{lengthLength: f.LargestAcknowledged__length()}
+		n, err := decode(&b, section)
+		if err != nil {
+			return nil, err
+		}
+		section = section[n:]
+
+		if uint64(b.Gap) > last {
+			return nil, fmt.Errorf("ACK gap goes below zero")
+		}
+		if b.Length == 0 {
+			last -= uint64(b.Gap)
+			continue
+		}
+		end := last - uint64(b.Gap)
+		if b.Length > end+1 {
+			return nil, fmt.Errorf("ACK block goes below zero")
+		}
+		rs = append(rs, ackRange{end, b.Length})
+		last = end - b.Length + 1
+	}
+	return rs, nil
+}
+
 func newAckFrame(rs []ackRange) (*frame, error) {
 	logf(logTypeFrame, "Making ACK frame %v", rs)
 
@@ -383,20 +431,33 @@ func (f streamFrame) Data__length() uintptr {
 	return uintptr(f.DataLength)
 }
 
+// Drop the length from a STREAM frame so that its data runs to the end
+// of the packet. This only works for the last frame in a packet.
+// Other frames are left alone.
+func (f *frame) omitLength() {
+	sf, ok := f.f.(*streamFrame)
+	if !ok {
+		return
+	}
+	sf.Typ &^= kFrameTypeFlagD
+	f.encoded = nil
+}
+
+// Make a STREAM frame. |data| is not copied, so it must not be
+// modified until the frame has been encoded.
 func newStreamFrame(stream uint32, offset uint64, data []byte) frame {
 	logf(logTypeFrame, "Creating stream frame with data length=%d", len(data))
 	assert(len(data) <= 65535)
 	return frame{
 		stream,
 		&streamFrame{
-			// TODO(ekr@tfm.com): One might want to allow non
-			// D bit, but not for now.
-			// Set all of SSOO to 1
+			// Set all of SSOO to 1. The D bit is cleared by
+			// omitLength() if this is the last frame in a packet.
 			kFrameTypeStream | 0x1e | kFrameTypeFlagD,
 			uint32(stream),
 			offset,
 			uint16(len(data)),
-			dup(data),
+			data,
 		},
 		nil,
 	}
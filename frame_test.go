@@ -33,7 +33,60 @@ func TestAckFrameTwoRanges(t *testing.T) {
 
 	fmt.Println("Encoded frame ", hex.EncodeToString(f.encoded))
 
-	n, _, err := decodeFrame(f.encoded)
+	n, d, err := decodeFrame(f.encoded)
 	assertNotError(t, err, "Couldn't decode ack frame")
 	assertEquals(t, n, uintptr(len(f.encoded)))
+
+	rs, err := d.f.(*ackFrame).ranges()
+	assertNotError(t, err, "Couldn't read ack ranges")
+	assertEquals(t, 2, len(rs))
+	for i := range ar {
+		assertEquals(t, ar[i], rs[i])
+	}
+}
+
+func TestStreamFrameFin(t *testing.T) {
+	f := newStreamFrame(1, 0, []byte("abc"))
+	err := f.encode()
+	assertNotError(t, err, "Couldn't encode stream frame")
+	_, d, err := decodeFrame(f.encoded)
+	assertNotError(t, err, "Couldn't decode stream frame")
+	assertEquals(t, frameType(0), d.f.(*streamFrame).Typ&kFrameTypeFlagF)
+
+	f = newStreamFrame(1, 0, []byte("abc"))
+	f.f.(*streamFrame).Typ |= kFrameTypeFlagF
+	err = f.encode()
+	assertNotError(t, err, "Couldn't encode stream frame")
+	_, d, err = decodeFrame(f.encoded)
+	assertNotError(t, err, "Couldn't decode stream frame")
+	assertEquals(t, kFrameTypeFlagF, d.f.(*streamFrame).Typ&kFrameTypeFlagF)
+}
+
+func TestStreamFrameOmitLength(t *testing.T) {
+	f := newStreamFrame(1, 0, []byte("abc"))
+	full, err := f.length()
+	assertNotError(t, err, "Couldn't encode stream frame")
+	f.omitLength()
+	short, err := f.length()
+	assertNotError(t, err, "Couldn't encode stream frame")
+	assertEquals(t, full-2, short)
+
+	// The data runs to the end of the packet.
+	n, d, err := decodeFrame(f.encoded)
+	assertNotError(t, err, "Couldn't decode stream frame")
+	assertEquals(t, uintptr(short), n)
+	assertByteEquals(t, []byte("abc"), d.f.(*streamFrame).Data)
+}
+
+func BenchmarkStreamFrameEncode(b *testing.B) {
+	data := make([]byte, 1024)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		f := newStreamFrame(1, uint64(i*len(data)), data)
+		_, err := f.length()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
 }
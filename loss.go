@@ -0,0 +1,192 @@
+package minq
+
+import (
+	"time"
+)
+
+// Loss detection, after draft-ietf-quic-recovery. A packet is lost
+// once one sent kPacketThreshold later is acknowledged, or once it is
+// kTimeThreshold (as a fraction) of an RTT older than the latest
+// acknowledged packet.
+const (
+	kPacketThreshold    = 3
+	kTimeThresholdNum   = 9
+	kTimeThresholdDenom = 8
+	kLossGranularity    = time.Millisecond
+)
+
+// Interface for an object that decides when packets are lost. The
+// connection tells it about each packet that needs to be
+// acknowledged, and about the ACKs that arrive. A packet that it
+// declares lost is no longer in flight, so any stream data in it is
+// sent again.
+type LossDetector interface {
+	// Packet |pn| was sent at |t|. |data| is true if it carries
+	// stream data.
+	PacketSent(pn uint64, t time.Time, data bool)
+
+	// Packets |acked| were acknowledged. Returns the packets that
+	// are lost as a result.
+	AckReceived(acked []uint64, rtt RttStats) []uint64
+
+	// The time from NextTimer() has passed. Returns the packets that
+	// are lost as a result.
+	TimerExpired(rtt RttStats) []uint64
+
+	// When TimerExpired() next needs to be called. A zero time means
+	// that there is no timer.
+	NextTimer(rtt RttStats) time.Time
+}
+
+// A packet that the default loss detector is waiting for.
+type lossPacket struct {
+	time time.Time
+	data bool
+}
+
+// The default LossDetector, which uses the packet and time thresholds
+// and a probe timeout.
+type defaultLossDetector struct {
+	sent         map[uint64]lossPacket
+	largestAcked uint64
+	ptoCount     int
+	lastDataSend time.Time // The last packet with stream data in it.
+}
+
+func newDefaultLossDetector() *defaultLossDetector {
+	return &defaultLossDetector{make(map[uint64]lossPacket), 0, 0, time.Time{}}
+}
+
+func (d *defaultLossDetector) PacketSent(pn uint64, t time.Time, data bool) {
+	d.sent[pn] = lossPacket{t, data}
+	if data {
+		d.lastDataSend = t
+	}
+}
+
+func (d *defaultLossDetector) AckReceived(acked []uint64, rtt RttStats) []uint64 {
+	for _, pn := range acked {
+		if _, ok := d.sent[pn]; !ok {
+			continue
+		}
+		delete(d.sent, pn)
+		d.ptoCount = 0
+		if pn > d.largestAcked {
+			d.largestAcked = pn
+		}
+	}
+	return d.detectLosses(rtt)
+}
+
+func (d *defaultLossDetector) TimerExpired(rtt RttStats) []uint64 {
+	lost := d.detectLosses(rtt)
+	return append(lost, d.checkPTO(rtt)...)
+}
+
+func (d *defaultLossDetector) NextTimer(rtt RttStats) time.Time {
+	if !d.dataInFlight() {
+		return time.Time{}
+	}
+	next := d.ptoDeadline(rtt)
+	if lost := d.lossTime(rtt); !lost.IsZero() && lost.Before(next) {
+		next = lost
+	}
+	return next
+}
+
+// How long after the latest acknowledged packet an earlier one can
+// still be acknowledged before it is considered lost.
+func lossDelay(rtt RttStats) time.Duration {
+	r := rtt.SmoothedRtt
+	if rtt.LatestRtt > r {
+		r = rtt.LatestRtt
+	}
+	if r == 0 {
+		r = kRetransmitInterval
+	}
+	d := r * kTimeThresholdNum / kTimeThresholdDenom
+	if d < kLossGranularity {
+		d = kLossGranularity
+	}
+	return d
+}
+
+// Declare packets sent before the largest acknowledged packet lost if
+// they pass either the packet or the time threshold.
+func (d *defaultLossDetector) detectLosses(rtt RttStats) (lost []uint64) {
+	delay := lossDelay(rtt)
+	now := time.Now()
+	for pn, sent := range d.sent {
+		if pn >= d.largestAcked {
+			continue
+		}
+		if d.largestAcked-pn >= kPacketThreshold || !now.Before(sent.time.Add(delay)) {
+			delete(d.sent, pn)
+			lost = append(lost, pn)
+		}
+	}
+	return
+}
+
+// Whether any packet with stream data in it is in flight.
+func (d *defaultLossDetector) dataInFlight() bool {
+	for _, sent := range d.sent {
+		if sent.data {
+			return true
+		}
+	}
+	return false
+}
+
+// The time at which the next packet with stream data in it passes
+// the time threshold, or the zero time if there isn't one. Packets
+// without stream data don't need a timer.
+func (d *defaultLossDetector) lossTime(rtt RttStats) (next time.Time) {
+	delay := lossDelay(rtt)
+	for pn, sent := range d.sent {
+		if !sent.data || pn >= d.largestAcked {
+			continue
+		}
+		lost := sent.time.Add(delay)
+		if next.IsZero() || lost.Before(next) {
+			next = lost
+		}
+	}
+	return
+}
+
+// When the probe timeout expires. This counts from the last packet
+// with stream data in it, because packets with only ACKs don't need
+// to be acknowledged. It backs off exponentially for each expiry
+// without an acknowledgment in between.
+func (d *defaultLossDetector) ptoDeadline(rtt RttStats) time.Time {
+	return d.lastDataSend.Add(rtt.retransmitInterval() << uint(d.ptoCount))
+}
+
+// If the probe timeout has expired, nothing we sent has been
+// acknowledged for a while. Declare the oldest packet with stream
+// data in it lost so that its data goes out again as a probe. When
+// the probe is acknowledged the packet threshold takes care of
+// anything else that was lost.
+func (d *defaultLossDetector) checkPTO(rtt RttStats) []uint64 {
+	if !d.dataInFlight() {
+		d.ptoCount = 0
+		return nil
+	}
+	if time.Now().Before(d.ptoDeadline(rtt)) {
+		return nil
+	}
+	d.ptoCount++
+
+	oldest := uint64(0)
+	found := false
+	for pn, sent := range d.sent {
+		if sent.data && (!found || pn < oldest) {
+			oldest = pn
+			found = true
+		}
+	}
+	logf(logTypeConnection, "Probe timeout %v, resending packet %v", d.ptoCount, oldest)
+	delete(d.sent, oldest)
+	return []uint64{oldest}
+}
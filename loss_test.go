@@ -0,0 +1,76 @@
+package minq
+
+import (
+	"testing"
+	"time"
+)
+
+// A loss detector that declares everything lost whenever the timer
+// is checked.
+type testLossDetector struct {
+	sent  []uint64
+	data  int
+	acked []uint64
+}
+
+func (d *testLossDetector) PacketSent(pn uint64, t time.Time, data bool) {
+	d.sent = append(d.sent, pn)
+	if data {
+		d.data++
+	}
+}
+
+func (d *testLossDetector) AckReceived(acked []uint64, rtt RttStats) []uint64 {
+	d.acked = append(d.acked, acked...)
+	return nil
+}
+
+func (d *testLossDetector) TimerExpired(rtt RttStats) []uint64 {
+	lost := d.sent
+	d.sent = nil
+	return lost
+}
+
+func (d *testLossDetector) NextTimer(rtt RttStats) time.Time {
+	if len(d.sent) == 0 {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+func TestLossDetectorInterface(t *testing.T) {
+	pair := newCsPair(t)
+	pair.handshake(t)
+	err := inputAll(pair.server)
+	assertNotError(t, err, "Couldn't finish handshake")
+	err = inputAll(pair.client)
+	assertNotError(t, err, "Couldn't read server ACK")
+	pair.client.mtuMax = pair.client.mtu // No MTU probes.
+
+	d := &testLossDetector{}
+	pair.client.SetLossDetector(d)
+	cs := pair.client.CreateStream()
+	pipe := pair.client.transport.(*testTransport).w
+	pipe.out = nil
+	_, err = cs.Write([]byte("abc"))
+	assertNotError(t, err, "Couldn't write")
+	assertEquals(t, 1, len(d.sent))
+	assertEquals(t, 1, d.data)
+	assertX(t, !pair.client.NextTimerExpiry().After(time.Now()), "Detector's timer wasn't used")
+
+	// Whatever the detector says is lost is sent again.
+	_, err = pair.client.CheckTimer()
+	assertNotError(t, err, "Couldn't check timer")
+	assertEquals(t, 2, len(pipe.out))
+	assertEquals(t, 2, d.data)
+
+	// The detector hears about ACKs.
+	err = inputAll(pair.server)
+	assertNotError(t, err, "Couldn't read data")
+	_, err = pair.server.sendQueued(true)
+	assertNotError(t, err, "Couldn't send ACK")
+	err = inputAll(pair.client)
+	assertNotError(t, err, "Couldn't read ACK")
+	assertEquals(t, 1, len(d.acked))
+	assertEquals(t, 0, pair.client.outstandingQueuedBytes())
+}
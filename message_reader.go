@@ -0,0 +1,71 @@
+package minq
+
+import (
+	"fmt"
+	"io"
+)
+
+// Find the length of the message at the start of |b|, including any
+// header. Return 0 if |b| is too short to tell. Negative lengths are
+// an error.
+type MessageLengthFunc func(b []byte) (int, error)
+
+// MessageReader reads whole messages from a stream that carries a
+// sequence of self-delimiting messages, such as length-prefixed
+// records. It buffers partial messages until the rest arrives.
+type MessageReader struct {
+	s      *Stream
+	length MessageLengthFunc
+	buf    []byte
+}
+
+// Read messages from |s|, using |length| to find where each ends.
+func NewMessageReader(s *Stream, length MessageLengthFunc) *MessageReader {
+	return &MessageReader{s, length, nil}
+}
+
+// Return the next complete message. Returns ErrorWouldBlock if the
+// whole message hasn't arrived yet and io.EOF once the stream is
+// finished. A stream that ends partway through a message gives
+// io.ErrUnexpectedEOF.
+func (r *MessageReader) ReadMessage() ([]byte, error) {
+	b := make([]byte, 1024)
+	for {
+		m, err := r.next()
+		if m != nil || err != nil {
+			return m, err
+		}
+
+		n, err := r.s.Read(b)
+		if err == io.EOF && len(r.buf) > 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		r.buf = append(r.buf, b[:n]...)
+	}
+}
+
+// Take a message from the buffer if there is a whole one.
+func (r *MessageReader) next() ([]byte, error) {
+	if len(r.buf) == 0 {
+		return nil, nil
+	}
+	l, err := r.length(r.buf)
+	if err != nil {
+		return nil, err
+	}
+	if l < 0 {
+		return nil, fmt.Errorf("Negative message length %v", l)
+	}
+	if l == 0 || l > len(r.buf) {
+		return nil, nil
+	}
+	m := r.buf[:l:l]
+	r.buf = r.buf[l:]
+	if len(r.buf) == 0 {
+		r.buf = nil
+	}
+	return m, nil
+}
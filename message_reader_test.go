@@ -0,0 +1,96 @@
+package minq
+
+import (
+	"io"
+	"testing"
+)
+
+// Messages with a two byte length prefix.
+func testMessageLength(b []byte) (int, error) {
+	if len(b) < 2 {
+		return 0, nil
+	}
+	return 2 + (int(b[0])<<8 | int(b[1])), nil
+}
+
+func TestMessageReader(t *testing.T) {
+	cTrans, _ := newTestTransportPair(true)
+	c := NewConnection(cTrans, RoleClient, testTlsConfig, nil)
+	s := c.ensureStream(1)
+	r := NewMessageReader(s, testMessageLength)
+
+	data := []byte{0, 3, 'a', 'b', 'c', 0, 0, 0, 2, 'd', 'e'}
+	offset := uint64(0)
+	feed := func(n int) {
+		s.newFrameData(offset, data[offset:offset+uint64(n)])
+		offset += uint64(n)
+	}
+
+	// Half a length.
+	feed(1)
+	_, err := r.ReadMessage()
+	assertEquals(t, ErrorWouldBlock, err)
+
+	// Part of the first message.
+	feed(3)
+	_, err = r.ReadMessage()
+	assertEquals(t, ErrorWouldBlock, err)
+
+	// The rest of the first, all of the second, and part of the third.
+	feed(5)
+	m, err := r.ReadMessage()
+	assertNotError(t, err, "Couldn't read first message")
+	assertByteEquals(t, []byte{0, 3, 'a', 'b', 'c'}, m)
+	m, err = r.ReadMessage()
+	assertNotError(t, err, "Couldn't read empty message")
+	assertByteEquals(t, []byte{0, 0}, m)
+	_, err = r.ReadMessage()
+	assertEquals(t, ErrorWouldBlock, err)
+
+	feed(2)
+	m, err = r.ReadMessage()
+	assertNotError(t, err, "Couldn't read last message")
+	assertByteEquals(t, []byte{0, 2, 'd', 'e'}, m)
+
+	s.receiveFin(offset)
+	_, err = r.ReadMessage()
+	assertEquals(t, io.EOF, err)
+}
+
+func TestMessageReaderTruncated(t *testing.T) {
+	cTrans, _ := newTestTransportPair(true)
+	c := NewConnection(cTrans, RoleClient, testTlsConfig, nil)
+	s := c.ensureStream(1)
+	r := NewMessageReader(s, testMessageLength)
+
+	s.newFrameData(0, []byte{0, 5, 'a'})
+	s.receiveFin(3)
+	_, err := r.ReadMessage()
+	assertEquals(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestMessageReaderNegativeLength(t *testing.T) {
+	cTrans, _ := newTestTransportPair(true)
+	c := NewConnection(cTrans, RoleClient, testTlsConfig, nil)
+	s := c.ensureStream(1)
+	r := NewMessageReader(s, func(b []byte) (int, error) {
+		return -1, nil
+	})
+
+	s.newFrameData(0, []byte{0, 5, 'a'})
+	_, err := r.ReadMessage()
+	assertError(t, err, "Accepted a negative length")
+}
+
+func TestMessageReaderMoreStreams(t *testing.T) {
+	cTrans, _ := newTestTransportPair(true)
+	c := NewConnection(cTrans, RoleClient, testTlsConfig, nil)
+	r := NewMessageReader(c.ensureStream(1), testMessageLength)
+
+	// The peer opening more streams doesn't lose the reader's stream.
+	c.ensureStream(41)
+	c.GetStream(1).newFrameData(0, []byte{0, 1, 'a'})
+	m, err := r.ReadMessage()
+	assertNotError(t, err, "Couldn't read message")
+	assertByteEquals(t, []byte{0, 1, 'a'}, m)
+}
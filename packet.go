@@ -46,6 +46,8 @@ const (
 	packetFlagLongHeader = 0x80
 	packetFlagC          = 0x40
 	packetFlagK          = 0x20
+
+	packetShortHeaderTypeMask = 0x1f
 )
 
 const (
@@ -108,19 +110,23 @@ func (p *packetHeader) hasConnId() bool {
 	return false
 }
 
+// Get the packet type. Short headers are always 1-RTT, so the type
+// of those comes from the key phase bit.
 func (p *packetHeader) getHeaderType() byte {
 	if isLongHeader(p) {
 		return p.Type & 0x7f
 	}
-	panic("Can't parse short header yet")
-	return 0
+	if isSet(p.Type, packetFlagK) {
+		return packetType1RTTProtectedPhase1
+	}
+	return packetType1RTTProtectedPhase0
 }
 
 func (p packetHeader) ConnectionID__length() uintptr {
 	if isLongHeader(&p) || isSet(p.Type, packetFlagC) {
 		return 8
 	}
-	return codecDefaultSize
+	return 0
 }
 
 func (p packetHeader) PacketNumber__length() uintptr {
@@ -129,9 +135,11 @@ func (p packetHeader) PacketNumber__length() uintptr {
 		return 4
 	}
 
-	switch p.Type {
-	case 1, 2, 3:
-		return 1 << p.Type
+	switch p.Type & packetShortHeaderTypeMask {
+	case 1:
+		return 1
+	case 2:
+		return 2
 	default:
 		return 4
 	}
@@ -140,7 +148,7 @@ func (p packetHeader) Version__length() uintptr {
 	if isLongHeader(&p) {
 		return 4
 	}
-	return codecDefaultSize
+	return 0
 }
 
 func (p *packetHeader) setLongHeaderType(typ byte) {
@@ -38,6 +38,29 @@ func TestLongHeader(t *testing.T) {
 	packetHeaderEDE(t, &p)
 }
 
+func TestShortHeader(t *testing.T) {
+	p := kTestpacketHeader
+	p.Version = 0
+
+	// Connection ID, key phase 1 and a 4 octet packet number.
+	p.Type = packetFlagC | packetFlagK | 0x03
+	res, err := encode(&p)
+	assertNotError(t, err, "Could not encode")
+	assertEquals(t, 1+8+4, len(res))
+	packetHeaderEDE(t, &p)
+	assertEquals(t, byte(packetType1RTTProtectedPhase1), p.getHeaderType())
+
+	// No connection ID and a 1 octet packet number.
+	p.Type = 0x01
+	p.ConnectionID = 0
+	p.PacketNumber = 0xef
+	res, err = encode(&p)
+	assertNotError(t, err, "Could not encode")
+	assertByteEquals(t, []byte{0x01, 0xef}, res)
+	packetHeaderEDE(t, &p)
+	assertEquals(t, byte(packetType1RTTProtectedPhase0), p.getHeaderType())
+}
+
 /* 
 * TODO(ekr@rtfm.com): Rewrite this code and merge it into 
 * connection.go 
@@ -0,0 +1,70 @@
+package minq
+
+import (
+	"time"
+)
+
+const (
+	kMinRetransmitInterval = 200 * time.Millisecond
+)
+
+// Round trip time estimates for a connection. All values are zero
+// until the first sample is taken.
+type RttStats struct {
+	SmoothedRtt time.Duration
+	RttVariance time.Duration
+	MinRtt      time.Duration
+	LatestRtt   time.Duration
+}
+
+// Update the estimates with a new sample. |ackDelay| is the time the
+// peer says it held the ACK for.
+func (r *RttStats) update(sample time.Duration, ackDelay time.Duration) {
+	r.LatestRtt = sample
+	if r.MinRtt == 0 || sample < r.MinRtt {
+		r.MinRtt = sample
+	}
+
+	// Only take out the ACK delay if it doesn't go below the minimum.
+	if sample-ackDelay >= r.MinRtt {
+		sample -= ackDelay
+	}
+
+	if r.SmoothedRtt == 0 {
+		r.SmoothedRtt = sample
+		r.RttVariance = sample / 2
+		return
+	}
+
+	diff := r.SmoothedRtt - sample
+	if diff < 0 {
+		diff = -diff
+	}
+	r.RttVariance = (3*r.RttVariance + diff) / 4
+	r.SmoothedRtt = (7*r.SmoothedRtt + sample) / 8
+}
+
+// How long to wait before retransmitting.
+func (r *RttStats) retransmitInterval() time.Duration {
+	if r.SmoothedRtt == 0 {
+		return kRetransmitInterval
+	}
+
+	i := r.SmoothedRtt + 4*r.RttVariance
+	if i < kMinRetransmitInterval {
+		i = kMinRetransmitInterval
+	}
+	return i
+}
+
+// Decode a 16-bit unsigned float as used for the ACK delay. Values
+// below 2^11 are exact; above that the top 5 bits are an exponent
+// and the rest a mantissa with an implicit leading bit.
+func decodeUfloat16(v uint16) uint64 {
+	if v < (1 << 11) {
+		return uint64(v)
+	}
+	exponent := uint(v >> 11)
+	mantissa := uint64(v&0x7ff) | 0x800
+	return mantissa << (exponent - 1)
+}
@@ -0,0 +1,35 @@
+package minq
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRttUpdate(t *testing.T) {
+	var r RttStats
+	assertEquals(t, kRetransmitInterval, r.retransmitInterval())
+
+	r.update(100*time.Millisecond, 0)
+	assertEquals(t, 100*time.Millisecond, r.SmoothedRtt)
+	assertEquals(t, 50*time.Millisecond, r.RttVariance)
+	assertEquals(t, 300*time.Millisecond, r.retransmitInterval())
+
+	// The ACK delay is taken out as long as it doesn't go below
+	// the minimum.
+	r.update(140*time.Millisecond, 20*time.Millisecond)
+	assertEquals(t, 140*time.Millisecond, r.LatestRtt)
+	assertEquals(t, 100*time.Millisecond, r.MinRtt)
+	assertEquals(t, 102500*time.Microsecond, r.SmoothedRtt)
+
+	r.update(110*time.Millisecond, 20*time.Millisecond)
+	assertEquals(t, 100*time.Millisecond, r.MinRtt)
+	assertEquals(t, 103437500*time.Nanosecond, r.SmoothedRtt)
+}
+
+func TestDecodeUfloat16(t *testing.T) {
+	assertEquals(t, uint64(0), decodeUfloat16(0))
+	assertEquals(t, uint64(2047), decodeUfloat16(2047))
+	assertEquals(t, uint64(2048), decodeUfloat16(1<<11))
+	assertEquals(t, uint64(4096), decodeUfloat16(2<<11))
+	assertEquals(t, uint64(0x7ff)<<30|uint64(1)<<41, decodeUfloat16(0xffff))
+}
@@ -1,7 +1,12 @@
 package minq
 
 import (
+	"container/heap"
+	"crypto/rand"
+	"errors"
+	"io"
 	"net"
+	"time"
 )
 
 // TransportFactory makes transports bound to a specific remote
@@ -20,11 +25,18 @@ type Server struct {
 	tls          TlsConfig
 	addrTable    map[string]*Connection
 	idTable      map[ConnectionId]*Connection
+	timers       serverTimerQueue
+	timerTable   map[*Connection]*serverTimer
+	random       io.Reader
 }
 
 // Interface for the handler object which the Server will call
 // to notify of events.
 type ServerHandler interface {
+	// A client at |addr| is trying to connect. Return false to turn
+	// it away before any connection state is created.
+	ShouldAccept(addr *net.UDPAddr) bool
+
 	// A new connection has been created and can be found in |c|.
 	NewConnection(c *Connection)
 }
@@ -55,23 +67,33 @@ func (s *Server) Input(addr *net.UDPAddr, data []byte) (*Connection, error) {
 	}
 
 	if conn == nil {
+		if !isLongHeader(&hdr) || hdr.getHeaderType() != packetTypeClientInitial {
+			logf(logTypeServer, "Ignoring packet for unknown connection from %v", addr)
+			return nil, nil
+		}
+		if s.handler != nil && !s.handler.ShouldAccept(addr) {
+			logf(logTypeServer, "Refusing connection from addr %v", addr)
+			return nil, s.refuse(addr, &hdr)
+		}
+
 		logf(logTypeServer, "New server connection from addr %v", addr)
 		trans, err := s.transFactory.makeTransport(addr)
 		if err != nil {
 			return nil, err
 		}
-		conn = NewConnection(trans, RoleServer, s.tls, nil)
+		conn = NewConnectionWithRandom(trans, RoleServer, s.tls, nil, s.random)
 		newConn = true
 		s.idTable[conn.serverConnId] = conn
 		s.addrTable[addr.String()] = conn
 	}
 
 	err = conn.Input(data)
-	if err == ErrorDestroyConnection {
-		delete(s.idTable, conn.serverConnId)
-		delete(s.addrTable, addr.String())
+	if errors.Is(err, ErrorFatal) {
+		logf(logTypeServer, "Fatal error on connection: %v", err)
+		s.removeConnection(conn)
 		return nil, nil
 	}
+	s.scheduleTimer(conn)
 
 	if newConn && s.handler != nil {
 		s.handler.NewConnection(conn)
@@ -80,6 +102,39 @@ func (s *Server) Input(addr *net.UDPAddr, data []byte) (*Connection, error) {
 	return conn, nil
 }
 
+// Tell the client that sent |hdr| to go away. This is a cleartext
+// CONNECTION_CLOSE, sent without making a connection. This draft has
+// no error code for refusing a connection, so the reason says why.
+func (s *Server) refuse(addr *net.UDPAddr, hdr *packetHeader) error {
+	trans, err := s.transFactory.makeTransport(addr)
+	if err != nil {
+		return err
+	}
+	pn, err := generateRand64(s.random)
+	if err != nil {
+		return err
+	}
+
+	f := newConnectionCloseFrame(kQuicErrorNoError, "Connection refused")
+	_, err = f.length()
+	if err != nil {
+		return err
+	}
+	p := packetHeader{
+		packetTypeServerCleartext | packetFlagLongHeader,
+		hdr.ConnectionID,
+		pn & 0x7fffffff,
+		hdr.Version,
+	}
+	b, err := encode(&p)
+	if err != nil {
+		return err
+	}
+	aead := &aeadFNV{}
+	b = append(b, aead.Seal(nil, encodeArgs(p.PacketNumber), f.encoded, b)...)
+	return trans.Send(b)
+}
+
 // Create a new QUIC server with the provide TLS config.
 func NewServer(factory TransportFactory, tls TlsConfig, handler ServerHandler) *Server {
 	return &Server{
@@ -88,5 +143,115 @@ func NewServer(factory TransportFactory, tls TlsConfig, handler ServerHandler) *
 		tls,
 		make(map[string]*Connection),
 		make(map[ConnectionId]*Connection),
+		nil,
+		make(map[*Connection]*serverTimer),
+		rand.Reader,
+	}
+}
+
+// Use |r| instead of crypto/rand for new connections. This is mostly
+// for deterministic tests.
+func (s *Server) SetRandom(r io.Reader) {
+	s.random = r
+}
+
+// Call CheckTimer() on each connection whose timer has expired and
+// return the time at which this should next be called. Connections
+// with nothing to retransmit are still checked every
+// kRetransmitInterval, because the application can write to them
+// without the server knowing. Each connection is checked at most once
+// per call, even if its timer is still due afterwards.
+func (s *Server) CheckTimer() time.Time {
+	now := time.Now()
+	var due []*Connection
+	for len(s.timers) > 0 && !s.timers[0].deadline.After(now) {
+		t := heap.Pop(&s.timers).(*serverTimer)
+		delete(s.timerTable, t.conn)
+		due = append(due, t.conn)
+	}
+
+	for _, conn := range due {
+		_, err := conn.CheckTimer()
+		if err != nil {
+			logf(logTypeServer, "Error checking timer on connection: %v", err)
+		}
+		if conn.isClosed() || errors.Is(err, ErrorFatal) {
+			s.removeConnection(conn)
+			continue
+		}
+		s.scheduleTimer(conn)
 	}
+
+	if len(s.timers) == 0 {
+		return time.Time{}
+	}
+	return s.timers[0].deadline
+}
+
+func (s *Server) scheduleTimer(conn *Connection) {
+	deadline := conn.NextTimerExpiry()
+	if deadline.IsZero() {
+		deadline = time.Now().Add(kRetransmitInterval)
+	}
+
+	t, ok := s.timerTable[conn]
+	if ok {
+		t.deadline = deadline
+		heap.Fix(&s.timers, t.index)
+		return
+	}
+	t = &serverTimer{conn, deadline, 0}
+	s.timerTable[conn] = t
+	heap.Push(&s.timers, t)
+}
+
+func (s *Server) removeConnection(conn *Connection) {
+	delete(s.idTable, conn.serverConnId)
+	for a, c := range s.addrTable {
+		if c == conn {
+			delete(s.addrTable, a)
+		}
+	}
+	t, ok := s.timerTable[conn]
+	if ok {
+		heap.Remove(&s.timers, t.index)
+		delete(s.timerTable, conn)
+	}
+}
+
+// A connection's place in the server's timer queue.
+type serverTimer struct {
+	conn     *Connection
+	deadline time.Time
+	index    int
+}
+
+// A min-heap of connection timers, for use with container/heap.
+type serverTimerQueue []*serverTimer
+
+func (q serverTimerQueue) Len() int {
+	return len(q)
+}
+
+func (q serverTimerQueue) Less(i, j int) bool {
+	return q[i].deadline.Before(q[j].deadline)
+}
+
+func (q serverTimerQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *serverTimerQueue) Push(x interface{}) {
+	t := x.(*serverTimer)
+	t.index = len(*q)
+	*q = append(*q, t)
+}
+
+func (q *serverTimerQueue) Pop() interface{} {
+	old := *q
+	t := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return t
 }
@@ -1,8 +1,10 @@
 package minq
 
 import (
+	mathrand "math/rand"
 	"net"
 	"testing"
+	"time"
 )
 
 // fake TransportFactory that comes populated with
@@ -52,10 +54,10 @@ func TestServer(t *testing.T) {
 	factory := &testTransportFactory{make(map[string]*testTransport)}
 	factory.addTransport(u, sTrans)
 
-	server := NewServer(factory, TlsConfig{}, nil)
+	server := NewServer(factory, testTlsConfig, nil)
 	assertNotNil(t, server, "Couldn't make server")
 
-	client := NewConnection(cTrans, RoleClient, TlsConfig{}, nil)
+	client := NewConnection(cTrans, RoleClient, testTlsConfig, nil)
 	assertNotNil(t, client, "Couldn't make client")
 
 	n, err := client.CheckTimer()
@@ -77,7 +79,7 @@ func TestServer(t *testing.T) {
 	u2, _ := net.ResolveUDPAddr("udp", "127.0.0.1:4444") // Just a fixed address
 	cTrans2, sTrans2 := newTestTransportPair(true)
 	factory.addTransport(u2, sTrans2)
-	client = NewConnection(cTrans2, RoleClient, TlsConfig{}, nil)
+	client = NewConnection(cTrans2, RoleClient, testTlsConfig, nil)
 	assertNotNil(t, client, "Couldn't make client")
 
 	n, err = client.CheckTimer()
@@ -90,3 +92,137 @@ func TestServer(t *testing.T) {
 	assertX(t, s1 != s3, "Got the same server connection back with a different address")
 	assertEquals(t, 2, len(server.addrTable))
 }
+
+func TestServerCheckTimer(t *testing.T) {
+	u, _ := net.ResolveUDPAddr("udp", "127.0.0.1:4443") // Just a fixed address
+
+	cTrans, sTrans := newTestTransportPair(true)
+	factory := &testTransportFactory{make(map[string]*testTransport)}
+	factory.addTransport(u, sTrans)
+
+	server := NewServer(factory, testTlsConfig, nil)
+	client := NewConnection(cTrans, RoleClient, testTlsConfig, nil)
+
+	_, err := client.CheckTimer()
+	assertNotError(t, err, "Couldn't send client initial")
+	s1, err := serverInputAll(t, sTrans, server, *u)
+	assertNotError(t, err, "Couldn't consume client initial")
+	err = inputAll(client)
+	assertNotError(t, err, "Error processing SH")
+
+	// Nothing is due yet.
+	next := server.CheckTimer()
+	assertX(t, next.After(time.Now()), "Server timer already due")
+	assertEquals(t, 0, len(cTrans.r.out))
+
+	// Pretend the server flight went out a while ago.
+	loss := s1.loss.(*defaultLossDetector)
+	loss.lastDataSend = loss.lastDataSend.Add(-2 * kRetransmitInterval)
+	server.scheduleTimer(s1)
+	server.CheckTimer()
+	assertX(t, len(cTrans.r.out) > 0, "Server didn't retransmit")
+
+	// A connection that is still due after being checked is only
+	// checked once.
+	pto := loss.ptoCount
+	loss.lastDataSend = loss.lastDataSend.Add(-time.Hour)
+	server.scheduleTimer(s1)
+	next = server.CheckTimer()
+	assertEquals(t, pto+1, loss.ptoCount)
+	assertX(t, !next.After(time.Now()), "Server timer not still due")
+
+	// A closed connection is dropped.
+	s1.setState(StateClosed)
+	server.timers[0].deadline = time.Now()
+	server.CheckTimer()
+	assertEquals(t, 0, len(server.addrTable))
+	assertEquals(t, 0, len(server.timers))
+}
+
+type testServerHandler struct {
+	accept bool
+	conns  int
+}
+
+func (h *testServerHandler) ShouldAccept(addr *net.UDPAddr) bool {
+	return h.accept
+}
+
+func (h *testServerHandler) NewConnection(c *Connection) {
+	h.conns++
+}
+
+func TestServerShouldAccept(t *testing.T) {
+	u, _ := net.ResolveUDPAddr("udp", "127.0.0.1:4443") // Just a fixed address
+
+	cTrans, sTrans := newTestTransportPair(true)
+	factory := &testTransportFactory{make(map[string]*testTransport)}
+	factory.addTransport(u, sTrans)
+
+	h := &testServerHandler{false, 0}
+	server := NewServer(factory, testTlsConfig, h)
+	client := NewConnection(cTrans, RoleClient, testTlsConfig, nil)
+
+	_, err := client.CheckTimer()
+	assertNotError(t, err, "Couldn't send client initial")
+	s, err := serverInputAll(t, sTrans, server, *u)
+	assertNotError(t, err, "Couldn't refuse client initial")
+	assertX(t, s == nil, "Connection was returned")
+	assertEquals(t, 0, h.conns)
+	assertEquals(t, 0, len(server.addrTable))
+	assertEquals(t, 0, len(server.idTable))
+
+	// The client is told.
+	err = inputAll(client)
+	assertNotError(t, err, "Couldn't read refusal")
+	assertEquals(t, StateClosed, client.GetState())
+
+	// Once the server is accepting, the client can connect.
+	h.accept = true
+	client = NewConnection(cTrans, RoleClient, testTlsConfig, nil)
+	_, err = client.CheckTimer()
+	assertNotError(t, err, "Couldn't send client initial")
+	s, err = serverInputAll(t, sTrans, server, *u)
+	assertNotError(t, err, "Couldn't consume client initial")
+	assertNotNil(t, s, "No connection")
+	assertEquals(t, 1, h.conns)
+}
+
+func TestServerSetRandom(t *testing.T) {
+	u, _ := net.ResolveUDPAddr("udp", "127.0.0.1:4443") // Just a fixed address
+
+	var ids []ConnectionId
+	for i := 0; i < 2; i++ {
+		cTrans, sTrans := newTestTransportPair(true)
+		factory := &testTransportFactory{make(map[string]*testTransport)}
+		factory.addTransport(u, sTrans)
+		server := NewServer(factory, testTlsConfig, nil)
+		server.SetRandom(mathrand.New(mathrand.NewSource(1)))
+
+		client := NewConnectionWithRandom(cTrans, RoleClient, testTlsConfig, nil, mathrand.New(mathrand.NewSource(2)))
+		_, err := client.CheckTimer()
+		assertNotError(t, err, "Couldn't send client initial")
+		s, err := serverInputAll(t, sTrans, server, *u)
+		assertNotError(t, err, "Couldn't consume client initial")
+		ids = append(ids, client.clientConnId, s.serverConnId)
+	}
+
+	assertEquals(t, ids[0], ids[2])
+	assertEquals(t, ids[1], ids[3])
+	assertX(t, ids[0] != ids[1], "Client and server IDs match")
+}
+
+func BenchmarkServerCheckTimerIdle(b *testing.B) {
+	server := NewServer(&testTransportFactory{make(map[string]*testTransport)}, testTlsConfig, nil)
+	for i := 0; i < 10000; i++ {
+		_, sTrans := newTestTransportPair(true)
+		conn := NewConnection(sTrans, RoleServer, testTlsConfig, nil)
+		server.idTable[conn.serverConnId] = conn
+		server.scheduleTimer(conn)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		server.CheckTimer()
+	}
+}
@@ -2,12 +2,16 @@ package minq
 
 import (
 	"encoding/hex"
+	"io"
+	"net"
+	"time"
 )
 
 type streamChunk struct {
 	offset uint64
 	data   []byte
 	pns    []uint64 // The packet numbers where we sent this.
+	fin    bool     // This is the end of the stream.
 }
 
 // A single QUIC stream.
@@ -18,53 +22,153 @@ type Stream struct {
 	readOffset  uint64
 	in          []streamChunk
 	out         []streamChunk
+	priority    int
+	readLimit   time.Time
+	writeLimit  time.Time
+	reset       bool // By the peer.
+	resetLocal  bool
+	finReceived bool
+	finOffset   uint64
+	finNotified bool
+	writeClosed bool
+	lastActive  time.Time
 }
 
-func (s *Stream) readAll() []byte {
-	logf(logTypeConnection, "stream readAll() %d chunks", len(s.in))
-	ret := make([]byte, 0) // Arbitrary
-
-	for i, b := range s.in {
+// Return the in-order data available at the current read offset
+// from the first chunk, discarding any chunks that have already been
+// read. Returns nil if nothing can be read.
+func (s *Stream) nextReadable() []byte {
+	for len(s.in) > 0 {
+		b := &s.in[0]
 		logf(logTypeConnection, "Next packet has offset %v, readOffset=%v", b.offset, s.readOffset)
 		if b.offset > s.readOffset {
-			break
+			return nil
 		}
 
-		s.in = s.in[i+1:]
 		if s.readOffset < (b.offset + uint64(len(b.data))) {
-			c := b.data[s.readOffset-b.offset:]
-			s.readOffset += uint64(len(c))
-			ret = append(ret, c...)
+			return b.data[s.readOffset-b.offset:]
 		}
+
+		s.dropFirstChunk()
+	}
+
+	return nil
+}
+
+// Mark |n| bytes from nextReadable() as read.
+func (s *Stream) consume(n int) {
+	s.readOffset += uint64(n)
+	b := &s.in[0]
+	if s.readOffset >= b.offset+uint64(len(b.data)) {
+		s.dropFirstChunk()
+	}
+}
+
+func (s *Stream) dropFirstChunk() {
+	// Clear the entry so the data can be collected even though the
+	// backing array is still referenced.
+	s.in[0] = streamChunk{}
+	s.in = s.in[1:]
+	if len(s.in) == 0 {
+		s.in = nil
+	}
+}
+
+func (s *Stream) readAll() []byte {
+	logf(logTypeConnection, "stream readAll() %d chunks", len(s.in))
+	ret := make([]byte, 0) // Arbitrary
+
+	for c := s.nextReadable(); c != nil; c = s.nextReadable() {
+		ret = append(ret, c...)
+		s.consume(len(c))
 	}
 
 	return ret
 }
 
-// Add data to a stream. Return true if this is readable now.
+// Add data to a stream. Return true if this is readable now. Data
+// that has already been read, such as a retransmission after the
+// stream was read to the end, isn't kept.
 func (s *Stream) newFrameData(offset uint64, payload []byte) bool {
 	logf(logTypeConnection, "Receiving stream with offset=%v, length=%v", offset, len(payload))
 	logf(logTypeTrace, "Stream payload %v", hex.EncodeToString(payload))
-	c := &streamChunk{offset, dup(payload), nil}
+	s.lastActive = time.Now()
+	if offset+uint64(len(payload)) <= s.readOffset {
+		return false
+	}
+	c := &streamChunk{offset, dup(payload), nil, false}
 
+	// Keep the chunks sorted by offset.
 	var i int
-	for i = 0; i < len(s.in); i++ {
-		if offset >= s.in[i].offset {
+	for i = len(s.in); i > 0; i-- {
+		if offset >= s.in[i-1].offset {
 			break
 		}
 	}
 
-	tmp := append(s.in[:i], *c)
-	tmp = append(tmp, s.in[i:]...)
-
-	s.in = tmp
+	s.in = append(s.in, streamChunk{})
+	copy(s.in[i+1:], s.in[i:])
+	s.in[i] = *c
 	logf(logTypeConnection, "Stream now has %v chunks", len(s.in))
 
 	return s.in[0].offset <= s.readOffset
 }
 
+// Note that the stream ends at |offset|.
+func (s *Stream) receiveFin(offset uint64) {
+	s.finReceived = true
+	s.finOffset = offset
+}
+
+// Return true the first time that everything up to the FIN has been
+// received.
+func (s *Stream) newlyFinished() bool {
+	if !s.finReceived || s.finNotified {
+		return false
+	}
+
+	// Find how far the contiguous data goes.
+	end := s.readOffset
+	for _, ch := range s.in {
+		if ch.offset > end {
+			break
+		}
+		if e := ch.offset + uint64(len(ch.data)); e > end {
+			end = e
+		}
+	}
+	if end < s.finOffset {
+		return false
+	}
+	s.finNotified = true
+	return true
+}
+
+// Whether the stream can be reset for being idle. Streams that
+// have never carried data, such as those of the peer's that were
+// skipped over, are left alone, as are streams that have been reset
+// or have finished in either direction.
+func (s *Stream) idleResettable() bool {
+	if s.reset || s.resetLocal || s.writeClosed || s.finReceived {
+		return false
+	}
+	return s.writeOffset > 0 || s.readOffset > 0 || len(s.in) > 0
+}
+
+// Note that the peer reset the stream and drop anything unread.
+// Returns false if it was already reset.
+func (s *Stream) resetByPeer() bool {
+	if s.reset {
+		return false
+	}
+	s.reset = true
+	s.in = nil
+	return true
+}
+
 func (s *Stream) send(payload []byte) {
-	s.out = append(s.out, streamChunk{s.writeOffset, dup(payload), nil})
+	s.lastActive = time.Now()
+	s.out = append(s.out, streamChunk{s.writeOffset, dup(payload), nil, false})
 	s.writeOffset += uint64(len(payload))
 }
 
@@ -91,6 +195,22 @@ func (s *Stream) removeAckedChunks(pn uint64) {
 	}
 }
 
+// Count the received bytes that can't be read yet because there is a
+// gap in front of them.
+func (s *Stream) bufferedBytes() (n int) {
+	end := s.readOffset
+	for _, ch := range s.in {
+		if ch.offset > end {
+			n += len(ch.data)
+			continue
+		}
+		if e := ch.offset + uint64(len(ch.data)); e > end {
+			end = e
+		}
+	}
+	return
+}
+
 func (s *Stream) outstandingQueuedBytes() (n int) {
 	for _, ch := range s.out {
 		n += len(ch.data)
@@ -99,32 +219,149 @@ func (s *Stream) outstandingQueuedBytes() (n int) {
 	return
 }
 
-// Write bytes to a stream. This function always succeeds, though the
-// bytes may end up being buffered.
-func (s *Stream) Write(b []byte) {
-	s.send(b)
+// Write bytes to a stream. This never blocks, though the bytes may
+// end up being buffered. A client can write before the handshake is
+// done; the data is sent in 1-RTT packets right behind its Finished.
+// It only fails if the connection is closed or the write deadline
+// has passed.
+func (s *Stream) Write(b []byte) (int, error) {
+	if s.c.isClosed() {
+		return 0, ErrorConnIsClosed
+	}
+	if s.writeClosed {
+		return 0, ErrorStreamIsClosed
+	}
+	if s.resetLocal {
+		return 0, ErrorStreamResetLocally
+	}
+	if deadlinePassed(s.writeLimit) {
+		return 0, ErrorDeadlineExceeded
+	}
+	// Split the data so that each chunk fits in a packet.
+	s.c.sendOnStream(s.id, b)
 	s.c.sendQueued(false)
+	return len(b), nil
 }
 
 // Read from a stream into a buffer. Up to |len(b)| bytes will be read,
 // and the number of bytes returned is in |n|.
 func (s *Stream) Read(b []byte) (int, error) {
 	logf(logTypeConnection, "Reading from stream %v", s.Id())
-	if len(s.in) == 0 {
-		return 0, ErrorWouldBlock
+	if s.reset {
+		return 0, ErrorStreamIsReset
 	}
-	if s.in[0].offset > s.readOffset {
-		return 0, ErrorWouldBlock
+	if s.resetLocal {
+		return 0, ErrorStreamResetLocally
 	}
-	n := copy(b, s.in[0].data)
-	if n == len(s.in[0].data) {
-		s.in = s.in[1:]
+	if deadlinePassed(s.readLimit) {
+		return 0, ErrorDeadlineExceeded
+	}
+	n := 0
+	for n < len(b) {
+		c := s.nextReadable()
+		if c == nil {
+			break
+		}
+		m := copy(b[n:], c)
+		s.consume(m)
+		n += m
+	}
+	if n == 0 {
+		if s.finReceived && s.readOffset >= s.finOffset {
+			// Everything has been read, so anything left is
+			// past the end and can go.
+			s.in = nil
+			return 0, io.EOF
+		}
+		return 0, ErrorWouldBlock
 	}
-	s.readOffset += uint64(n)
 	return n, nil
 }
 
+// Close the sending side of the stream. The peer gets a FIN after
+// whatever has already been written. The stream can still be read.
+// Stream 0 can't be closed.
+func (s *Stream) Close() error {
+	if s.c.isClosed() {
+		return ErrorConnIsClosed
+	}
+	if s.id == 0 {
+		return ErrorStreamIsHandshake
+	}
+	if s.writeClosed {
+		return ErrorStreamIsClosed
+	}
+	s.writeClosed = true
+	s.lastActive = time.Now()
+	s.out = append(s.out, streamChunk{s.writeOffset, nil, nil, true})
+	s.c.sendQueued(false)
+	return nil
+}
+
+// Abandon the stream, telling the peer with |code|. Anything that
+// hasn't been sent is discarded. Stream 0 can't be reset.
+func (s *Stream) Reset(code ApplicationError) error {
+	if s.c.isClosed() {
+		return ErrorConnIsClosed
+	}
+	if s.id == 0 {
+		return ErrorStreamIsHandshake
+	}
+	if s.c.state != StateEstablished {
+		return ErrorWouldBlock
+	}
+	if s.reset || s.resetLocal {
+		return nil
+	}
+	ec, err := code.errorCode()
+	if err != nil {
+		return err
+	}
+	return s.c.resetStream(s, ec)
+}
+
+// Set the send priority of a stream. Data on streams with a higher
+// priority is sent first. The default is 0.
+func (s *Stream) SetPriority(p int) {
+	s.priority = p
+}
+
+// Set the time after which Read() fails with ErrorDeadlineExceeded.
+// A zero time means no deadline.
+func (s *Stream) SetReadDeadline(t time.Time) {
+	s.readLimit = t
+}
+
+// Set the time after which Write() fails with ErrorDeadlineExceeded.
+// A zero time means no deadline.
+func (s *Stream) SetWriteDeadline(t time.Time) {
+	s.writeLimit = t
+}
+
+// Set both the read and write deadlines.
+func (s *Stream) SetDeadline(t time.Time) {
+	s.SetReadDeadline(t)
+	s.SetWriteDeadline(t)
+}
+
+func deadlinePassed(t time.Time) bool {
+	return !t.IsZero() && !time.Now().Before(t)
+}
+
+// Get a net.Conn which reads and writes this stream. See
+// BlockingStream for the conditions.
+func (s *Stream) NetConn() (net.Conn, error) {
+	return NewBlockingStream(s)
+}
+
 // Get the ID of a stream.
 func (s *Stream) Id() uint32 {
 	return s.id
 }
+
+// Get the total number of bytes that the peer sent on the stream.
+// The second value is false until the FIN has arrived and the size is
+// known.
+func (s *Stream) FinalSize() (uint64, bool) {
+	return s.finOffset, s.finReceived
+}
@@ -0,0 +1,110 @@
+package minq
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStreamReadOutOfOrder(t *testing.T) {
+	var s Stream
+
+	assertX(t, !s.newFrameData(3, []byte("def")), "Stream shouldn't be readable")
+	assertX(t, s.newFrameData(0, []byte("abc")), "Stream should be readable")
+	// A retransmission overlapping what we have.
+	s.newFrameData(2, []byte("cd"))
+	s.newFrameData(6, []byte("gh"))
+
+	b := make([]byte, 2)
+	n, err := s.Read(b)
+	assertNotError(t, err, "Couldn't read")
+	assertByteEquals(t, []byte("ab"), b[:n])
+
+	b = make([]byte, 100)
+	n, err = s.Read(b)
+	assertNotError(t, err, "Couldn't read")
+	assertByteEquals(t, []byte("cdefgh"), b[:n])
+
+	_, err = s.Read(b)
+	assertEquals(t, ErrorWouldBlock, err)
+	assertEquals(t, 0, len(s.in))
+}
+
+func TestStreamFinalSize(t *testing.T) {
+	var s Stream
+
+	s.newFrameData(0, []byte("abc"))
+	_, ok := s.FinalSize()
+	assertX(t, !ok, "Final size known before the FIN")
+
+	s.receiveFin(5)
+	n, ok := s.FinalSize()
+	assertX(t, ok, "Final size not known after the FIN")
+	assertEquals(t, uint64(5), n)
+}
+
+func TestStreamReleasedAtEOF(t *testing.T) {
+	var s Stream
+
+	s.newFrameData(0, []byte("abc"))
+	s.receiveFin(3)
+	b := make([]byte, 10)
+	n, err := s.Read(b)
+	assertNotError(t, err, "Couldn't read")
+	assertEquals(t, 3, n)
+	_, err = s.Read(b)
+	assertEquals(t, io.EOF, err)
+
+	// Retransmissions after the end aren't kept.
+	s.newFrameData(0, []byte("abc"))
+	s.newFrameData(1, []byte("bc"))
+	assertEquals(t, 0, len(s.in))
+}
+
+func TestStreamDeadlines(t *testing.T) {
+	pair := newCsPair(t)
+	pair.handshake(t)
+	s := pair.client.CreateStream()
+
+	s.SetDeadline(time.Now().Add(time.Hour))
+	n, err := s.Write([]byte("abc"))
+	assertNotError(t, err, "Couldn't write before the deadline")
+	assertEquals(t, 3, n)
+	_, err = s.Read(make([]byte, 10))
+	assertEquals(t, ErrorWouldBlock, err)
+
+	s.SetDeadline(time.Now().Add(-time.Second))
+	_, err = s.Write([]byte("abc"))
+	assertEquals(t, ErrorDeadlineExceeded, err)
+	_, err = s.Read(make([]byte, 10))
+	assertEquals(t, ErrorDeadlineExceeded, err)
+	ne, ok := err.(net.Error)
+	assertX(t, ok && ne.Timeout(), "Not a timeout")
+
+	// Clearing the deadline.
+	s.SetDeadline(time.Time{})
+	_, err = s.Write([]byte("abc"))
+	assertNotError(t, err, "Couldn't write without a deadline")
+}
+
+func BenchmarkStreamRead(b *testing.B) {
+	chunk := make([]byte, 1024)
+	buf := make([]byte, 100)
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		var s Stream
+		for j := 0; j < 1000; j++ {
+			s.newFrameData(uint64(j*len(chunk)), chunk)
+		}
+		b.StartTimer()
+
+		for {
+			_, err := s.Read(buf)
+			if err != nil {
+				break
+			}
+		}
+	}
+}
@@ -1,28 +1,74 @@
 package minq
 
 import (
+	"crypto/x509"
 	"encoding/hex"
 	"fmt"
 	"github.com/bifurcation/mint"
 )
 
 type TlsConfig struct {
+	// The name to verify the server's certificate against.
+	// Defaults to "localhost".
+	ServerName string
+
+	// The roots used to verify the server's certificate. If nil,
+	// the system roots are used.
+	RootCAs *x509.CertPool
+
+	// Don't verify the server's certificate at all. This is
+	// only for testing.
+	InsecureSkipVerify bool
+
+	// The application protocols to offer or accept, in order of
+	// preference. Defaults to kQuicALPNToken.
+	ALPN []string
+}
+
+func (c TlsConfig) serverName() string {
+	if c.ServerName == "" {
+		return "localhost"
+	}
+	return c.ServerName
+}
+
+func (c TlsConfig) alpn() []string {
+	if len(c.ALPN) == 0 {
+		return []string{kQuicALPNToken}
+	}
+	return c.ALPN
 }
 
 func (c TlsConfig) toMint() *mint.Config {
 	// TODO(ekr@rtfm.com): Provide a real config
 	return &mint.Config{
-		ServerName:  "localhost",
+		ServerName:  c.serverName(),
 		NonBlocking: true,
-		NextProtos:  []string{kQuicALPNToken},
+		NextProtos:  c.alpn(),
 	}
 }
 
+// A handshake failure that TLS signals with |alert|.
+type tlsAlertError struct {
+	alert mint.Alert
+	err   error
+}
+
+func (e *tlsAlertError) Error() string {
+	return e.err.Error()
+}
+
+func (e *tlsAlertError) Unwrap() error {
+	return e.err
+}
+
 type tlsConn struct {
+	config   TlsConfig
 	conn     *connBuffer
 	tls      *mint.Conn
 	finished bool
 	cs       *mint.CipherSuiteParams
+	authErr  error
 }
 
 func newTlsConn(conf TlsConfig, role uint8) *tlsConn {
@@ -31,14 +77,60 @@ func newTlsConn(conf TlsConfig, role uint8) *tlsConn {
 		isClient = false
 	}
 
-	c := newConnBuffer()
-
-	return &tlsConn{
-		c,
-		mint.NewConn(c, conf.toMint(), isClient),
+	c := &tlsConn{
+		conf,
+		newConnBuffer(),
+		nil,
 		false,
 		nil,
+		nil,
 	}
+
+	mconf := conf.toMint()
+	if isClient {
+		mconf.AuthCertificate = c.verifyCertificate
+	}
+	c.tls = mint.NewConn(c.conn, mconf, isClient)
+
+	return c
+}
+
+// Check the server's certificate chain. Any error is also
+// remembered so that we can report it if the handshake fails.
+func (c *tlsConn) verifyCertificate(chain []mint.CertificateEntry) error {
+	if c.config.InsecureSkipVerify {
+		logf(logTypeTls, "Skipping certificate verification")
+		return nil
+	}
+
+	if len(chain) == 0 {
+		c.authErr = fmt.Errorf("Server sent no certificate")
+		return c.authErr
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         c.config.RootCAs,
+		DNSName:       c.config.serverName(),
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, e := range chain[1:] {
+		opts.Intermediates.AddCert(e.CertData)
+	}
+
+	_, c.authErr = chain[0].CertData.Verify(opts)
+	if c.authErr != nil {
+		logf(logTypeTls, "Certificate verification failed: %v", c.authErr)
+	}
+	return c.authErr
+}
+
+func (c *tlsConn) alpnAcceptable(proto string) bool {
+	for _, p := range c.config.alpn() {
+		if p == proto {
+			return true
+		}
+	}
+	return false
 }
 
 func (c *tlsConn) handshake(input []byte) ([]byte, error) {
@@ -58,9 +150,9 @@ func (c *tlsConn) handshake(input []byte) ([]byte, error) {
 		logf(logTypeTls, "TLS handshake complete")
 		st := c.tls.GetConnectionState()
 		logf(logTypeTls, "Negotiated ALPN = %v", st.NextProto)
-		// TODO(ekr@rtfm.com): Abort on ALPN mismatch when others do.
-		if st.NextProto != kQuicALPNToken {
-			logf(logTypeTls, "ALPN mismatch %v != %v", st.NextProto, kQuicALPNToken)
+		if !c.alpnAcceptable(st.NextProto) {
+			return nil, fatal(&tlsAlertError{mint.AlertNoApplicationProtocol,
+				fmt.Errorf("Negotiated ALPN %q, wanted one of %v", st.NextProto, c.config.alpn())})
 		}
 		cs := st.CipherSuite
 		c.cs = &cs
@@ -68,7 +160,11 @@ func (c *tlsConn) handshake(input []byte) ([]byte, error) {
 	case mint.AlertWouldBlock:
 		logf(logTypeTls, "TLS would have blocked")
 	default:
-		return nil, fmt.Errorf("TLS sent an alert %v", alert)
+		if c.authErr != nil {
+			return nil, fatal(&tlsAlertError{alert,
+				fmt.Errorf("TLS certificate verification failed: %v", c.authErr)})
+		}
+		return nil, fatal(&tlsAlertError{alert, fmt.Errorf("TLS sent an alert %v", alert)})
 	}
 	logf(logTypeTls, "TLS wrote %d bytes", c.conn.OutputLen())
 
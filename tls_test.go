@@ -0,0 +1,67 @@
+package minq
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/bifurcation/mint"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func makeTestCert(t *testing.T, name string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assertNotError(t, err, "Couldn't make key")
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if isCA {
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		tmpl.DNSNames = []string{name}
+	}
+	if parent == nil {
+		parent = tmpl
+		parentKey = key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	assertNotError(t, err, "Couldn't make certificate")
+	cert, err := x509.ParseCertificate(der)
+	assertNotError(t, err, "Couldn't parse certificate")
+
+	return cert, key
+}
+
+func TestVerifyCertificate(t *testing.T) {
+	root, rootKey := makeTestCert(t, "Test Root", true, nil, nil)
+	leaf, _ := makeTestCert(t, "example.com", false, root, rootKey)
+	other, _ := makeTestCert(t, "Other Root", true, nil, nil)
+	chain := []mint.CertificateEntry{{CertData: leaf}}
+
+	good := x509.NewCertPool()
+	good.AddCert(root)
+	c := newTlsConn(TlsConfig{ServerName: "example.com", RootCAs: good}, RoleClient)
+	assertNotError(t, c.verifyCertificate(chain), "Should accept a good root")
+
+	bad := x509.NewCertPool()
+	bad.AddCert(other)
+	c = newTlsConn(TlsConfig{ServerName: "example.com", RootCAs: bad}, RoleClient)
+	assertError(t, c.verifyCertificate(chain), "Should reject a bad root")
+	assertError(t, c.authErr, "Should remember the failure")
+
+	c = newTlsConn(TlsConfig{ServerName: "example.org", RootCAs: good}, RoleClient)
+	assertError(t, c.verifyCertificate(chain), "Should reject the wrong name")
+
+	c = newTlsConn(TlsConfig{ServerName: "example.com", RootCAs: bad, InsecureSkipVerify: true}, RoleClient)
+	assertNotError(t, c.verifyCertificate(chain), "Should skip verification")
+}
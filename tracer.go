@@ -0,0 +1,21 @@
+package minq
+
+import ()
+
+// Interface for an object that is told about the major events in the
+// life of a connection, e.g., so that they can be exported as spans
+// to a tracing system.
+type Tracer interface {
+	// The handshake has started: the client has sent its
+	// ClientInitial, or the server has received it.
+	HandshakeStarted(c *Connection)
+
+	// The handshake has completed.
+	HandshakeComplete(c *Connection)
+
+	// Stream |s| was opened, either locally or by the peer.
+	StreamOpened(c *Connection, s *Stream)
+
+	// The connection is closed.
+	ConnectionClosed(c *Connection)
+}
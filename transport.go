@@ -1,6 +1,8 @@
 package minq
 
-import ()
+import (
+	"time"
+)
 
 // Interface for an object to send packets. Each Transport
 // is bound to some particular remote address (or in testing
@@ -8,3 +10,13 @@ import ()
 type Transport interface {
 	Send(p []byte) error
 }
+
+// A Transport which can also be read from. Connect() needs one of
+// these; otherwise the application reads packets itself.
+type ReadTransport interface {
+	Transport
+
+	// Read the next packet. Returns ErrorWouldBlock if none has
+	// arrived by |deadline|. A zero deadline means wait forever.
+	Read(deadline time.Time) ([]byte, error)
+}
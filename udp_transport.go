@@ -3,6 +3,7 @@ package minq
 import (
 	"fmt"
 	"net"
+	"time"
 )
 
 type UdpTransport struct {
@@ -23,10 +24,56 @@ func (t *UdpTransport) Send(p []byte) error {
 	return nil
 }
 
+// Get the address of the local socket.
+func (t *UdpTransport) LocalAddr() net.Addr {
+	return t.u.LocalAddr()
+}
+
+// Get the address of the peer.
+func (t *UdpTransport) RemoteAddr() net.Addr {
+	return t.r
+}
+
+// Read the next packet from the remote address, ignoring anything
+// from elsewhere. This is only useful on a socket dedicated to this
+// transport, as a client's is.
+func (t *UdpTransport) Read(deadline time.Time) ([]byte, error) {
+	err := t.u.SetReadDeadline(deadline)
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, 8192)
+	for {
+		n, addr, err := t.u.ReadFromUDP(b)
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				return nil, ErrorWouldBlock
+			}
+			return nil, err
+		}
+		if n == len(b) {
+			return nil, fmt.Errorf("Underread from UDP socket")
+		}
+		if !addr.IP.Equal(t.r.IP) || addr.Port != t.r.Port {
+			logf(logTypeUdp, "Ignoring packet from %v", addr)
+			continue
+		}
+		logf(logTypeUdp, "Received message of len %v", n)
+		return b[:n], nil
+	}
+}
+
 func NewUdpTransport(u *net.UDPConn, r *net.UDPAddr) *UdpTransport {
 	return &UdpTransport{u, r}
 }
 
+// Set the socket receive and send buffer sizes. A size of zero leaves
+// that buffer alone.
+func (t *UdpTransport) SetBufferSizes(read int, write int) error {
+	return setUdpBufferSizes(t.u, read, write)
+}
+
 type UdpTransportFactory struct {
 	local *net.UDPConn
 }
@@ -39,3 +86,26 @@ func (f *UdpTransportFactory) makeTransport(remote *net.UDPAddr) (Transport, err
 func NewUdpTransportFactory(sock *net.UDPConn) *UdpTransportFactory {
 	return &UdpTransportFactory{sock}
 }
+
+// Set the socket receive and send buffer sizes for all the transports
+// made by this factory. A size of zero leaves that buffer alone.
+func (f *UdpTransportFactory) SetBufferSizes(read int, write int) error {
+	return setUdpBufferSizes(f.local, read, write)
+}
+
+func setUdpBufferSizes(sock *net.UDPConn, read int, write int) error {
+	if read > 0 {
+		err := sock.SetReadBuffer(read)
+		if err != nil {
+			return err
+		}
+	}
+	if write > 0 {
+		err := sock.SetWriteBuffer(write)
+		if err != nil {
+			return err
+		}
+	}
+
+	return checkUdpBufferSizes(sock, read, write)
+}
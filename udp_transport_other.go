@@ -0,0 +1,13 @@
+//go:build !unix
+
+package minq
+
+import (
+	"net"
+)
+
+// There is no portable way to read the buffer sizes back here, so
+// rely on the errors from SetReadBuffer() and SetWriteBuffer().
+func checkUdpBufferSizes(sock *net.UDPConn, read int, write int) error {
+	return nil
+}
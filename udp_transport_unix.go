@@ -0,0 +1,44 @@
+//go:build unix
+
+package minq
+
+import (
+	"net"
+	"syscall"
+)
+
+// The OS may clamp the buffer sizes without complaining, so check.
+func checkUdpBufferSizes(sock *net.UDPConn, read int, write int) error {
+	actualRead, actualWrite, err := udpBufferSizes(sock)
+	if err != nil {
+		return err
+	}
+	if actualRead < read {
+		logf(logTypeUdp, "Receive buffer clamped to %v, wanted %v", actualRead, read)
+	}
+	if actualWrite < write {
+		logf(logTypeUdp, "Send buffer clamped to %v, wanted %v", actualWrite, write)
+	}
+	return nil
+}
+
+// Get the socket receive and send buffer sizes as reported by the OS.
+func udpBufferSizes(sock *net.UDPConn) (read int, write int, err error) {
+	raw, err := sock.SyscallConn()
+	if err != nil {
+		return
+	}
+
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		read, serr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+		if serr != nil {
+			return
+		}
+		write, serr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+	})
+	if err == nil {
+		err = serr
+	}
+	return
+}
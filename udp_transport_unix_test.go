@@ -0,0 +1,27 @@
+//go:build unix
+
+package minq
+
+import (
+	"net"
+	"testing"
+)
+
+func TestUdpBufferSizes(t *testing.T) {
+	addr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	assertNotError(t, err, "Couldn't resolve address")
+	sock, err := net.ListenUDP("udp", addr)
+	assertNotError(t, err, "Couldn't open socket")
+	defer sock.Close()
+
+	f := NewUdpTransportFactory(sock)
+	err = f.SetBufferSizes(65536, 32768)
+	assertNotError(t, err, "Couldn't set buffer sizes")
+
+	// Linux reports double what was asked for, but anything at least
+	// as big will do.
+	read, write, err := udpBufferSizes(sock)
+	assertNotError(t, err, "Couldn't get buffer sizes")
+	assertX(t, read >= 65536, "Receive buffer too small")
+	assertX(t, write >= 32768, "Send buffer too small")
+}